@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"time"
+)
+
+var looseVersionRx = regexp.MustCompile(`([0-9]+\.[0-9]+\.[0-9]+)`)
+
+// detectWebotsVersion guesses the version of a webots installation,
+// first from its resources/version.txt file, then by running webots
+// --version.
+func detectWebotsVersion(dir string) (WebotsVersion, error) {
+	content, err := ioutil.ReadFile(path.Join(dir, "resources", "version.txt"))
+	if err == nil {
+		if m := looseVersionRx.FindString(string(content)); len(m) != 0 {
+			return ParseWebotsVersion(m)
+		}
+	} else if os.IsNotExist(err) == false {
+		return WebotsVersion{}, err
+	}
+
+	cmd := exec.Command(path.Join(dir, "webots"), "--version")
+	cmd.Env = append(os.Environ(), "WEBOTS_HOME="+dir)
+	out, err := cmd.Output()
+	if err != nil {
+		return WebotsVersion{}, fmt.Errorf("Could not detect webots version in %s: %s", dir, err)
+	}
+	m := looseVersionRx.FindString(string(out))
+	if len(m) == 0 {
+		return WebotsVersion{}, fmt.Errorf("Could not detect webots version in %s from output '%s'", dir, out)
+	}
+	return ParseWebotsVersion(m)
+}
+
+// adoptInstallation moves a manual installation of webots to the
+// workpath, and makes it the used version.
+func adoptInstallation(installpath, workpath string, gid int) error {
+	lock, err := NewFileLock(path.Join(workpath, "global.lock"))
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	v, err := detectWebotsVersion(installpath)
+	if err != nil {
+		return err
+	}
+
+	dest := path.Join(workpath, v.String())
+	if _, err := os.Lstat(dest); err == nil {
+		return fmt.Errorf("Cannot adopt %s, version %s is already managed in %s", installpath, v, dest)
+	} else if os.IsNotExist(err) == false {
+		return err
+	}
+
+	log.Printf("Adopting webots %s from %s", v, installpath)
+	if err := moveInstallation(installpath, dest, workpath); err != nil {
+		return fmt.Errorf("Could not move %s to %s: %s", installpath, dest, err)
+	}
+
+	err = filepath.Walk(dest, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(p, -1, gid); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return os.Chmod(p, fi.Mode().Perm()|0070|os.ModeSetgid)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	usedpath := path.Join(workpath, "used")
+	var previous *WebotsVersion
+	if dest, err := os.Readlink(usedpath); err == nil {
+		if pv, err := ParseWebotsVersion(dest); err == nil {
+			previous = &pv
+		}
+	}
+	if err := os.RemoveAll(usedpath); err != nil {
+		return err
+	}
+	if err := os.Symlink(v.String(), usedpath); err != nil {
+		return err
+	}
+	if err := recordUse(workpath, previous, v); err != nil {
+		return err
+	}
+
+	templates, err := NewHasHTemplateManager(path.Join(workpath, "templates"))
+	if err != nil {
+		return err
+	}
+	if err := templates.ApplyTemplates(dest, v); err != nil {
+		return err
+	}
+
+	log.Printf("Using now adopted version %s", v)
+	return nil
+}
+
+// moveInstallation moves the tree src to dest. If they are on
+// different filesystems, src is copied to a temporary directory of
+// the workpath, moved in place once complete, and only then removed.
+func moveInstallation(src, dest, workpath string) error {
+	err := os.Rename(src, dest)
+	if lerr, ok := err.(*os.LinkError); ok == false || lerr.Err != syscall.EXDEV {
+		return err
+	}
+
+	log.Printf("%s is on another filesystem, copying it", src)
+	tmp, err := ioutil.TempDir(workpath, extractionPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := copyTree(src, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyTree copies the directories, regular files and symlinks of src
+// in the existing directory dest, keeping their mode and modification
+// time.
+func copyTree(src, dest string) error {
+	var dirs []string
+	err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dest, rel)
+		switch {
+		case fi.IsDir():
+			if rel != "." {
+				if err := os.Mkdir(target, 0700); err != nil {
+					return err
+				}
+			}
+			// permissions are set once the directory is filled
+			dirs = append(dirs, p)
+			return nil
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case fi.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if err := writeUnshared(target, f, fi.Mode()); err != nil {
+				return err
+			}
+			return os.Chtimes(target, time.Now(), fi.ModTime())
+		}
+		return fmt.Errorf("Cannot copy special file %s", p)
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fi, err := os.Stat(dirs[i])
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, dirs[i])
+		if err != nil {
+			return err
+		}
+		target := path.Join(dest, rel)
+		if err := os.Chmod(target, fi.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, time.Now(), fi.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
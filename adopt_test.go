@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCopyTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webots-manager-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := path.Join(dir, "webots")
+	testdata := []struct {
+		name, link string
+		mode       os.FileMode
+	}{
+		{"webots", "", 0755},
+		{"lib/libController.so.8", "", 0644},
+		{"lib/libController.so", "libController.so.8", 0},
+		{"resources/version.txt", "", 0444},
+	}
+	for _, d := range testdata {
+		p := path.Join(src, d.name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if len(d.link) != 0 {
+			err = os.Symlink(d.link, p)
+		} else {
+			err = ioutil.WriteFile(p, []byte(d.name), d.mode)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// directories are copied before they are made read-only
+	if err := os.Chmod(path.Join(src, "resources"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(path.Join(src, "resources"), 0755)
+
+	dest := path.Join(dir, "copy")
+	if err := os.Mkdir(dest, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyTree(src, dest); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(path.Join(dest, "resources"), 0755)
+
+	for _, d := range testdata {
+		p := path.Join(dest, d.name)
+		if len(d.link) != 0 {
+			link, err := os.Readlink(p)
+			if err != nil || link != d.link {
+				t.Errorf("Expected %s to link to %s, got %s (%v)", d.name, d.link, link, err)
+			}
+			continue
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Errorf("Missing %s: %s", d.name, err)
+			continue
+		}
+		if fi.Mode().Perm() != d.mode {
+			t.Errorf("Expected mode %s for %s, got %s", d.mode, d.name, fi.Mode().Perm())
+		}
+		content, err := ioutil.ReadFile(p)
+		if err != nil || string(content) != d.name {
+			t.Errorf("Unexpected content %q for %s (%v)", content, d.name, err)
+		}
+	}
+	if fi, err := os.Stat(path.Join(dest, "resources")); err != nil || fi.Mode().Perm() != 0555 {
+		t.Errorf("Directory mode was not copied: %v %v", fi, err)
+	}
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A bundle is a tar file containing a manifest.json, a whole
+// installed tree under webots/ (the same layout than official
+// archives), and the templates that applies to it under templates/.
+
+type ManifestEntry struct {
+	Path   string
+	Size   int64
+	Mode   os.FileMode
+	Sha256 string
+}
+
+type BundleManifest struct {
+	Version   string
+	Arch      string
+	Created   time.Time
+	Files     []ManifestEntry
+	Templates []Template
+}
+
+const (
+	bundleManifestName   = "manifest.json"
+	bundleTreePrefix     = "webots/"
+	bundleTemplatePrefix = "templates/"
+)
+
+func (m *SymlinkWebotsManager) isInstalled(v WebotsVersion) bool {
+	for _, vv := range m.installed {
+		if vv == v {
+			return true
+		}
+	}
+	return false
+}
+
+// bundleFiles lists all files of an installed version that should be
+// exported, i.e. everything but installed templates. Files overridden
+// by templates are exported from their backup, returned in originals.
+func (m *SymlinkWebotsManager) bundleFiles(v WebotsVersion, templates []Template) ([]string, map[string]string, error) {
+	root := path.Join(m.workpath, v.String())
+	excluded := make(map[string]bool)
+	created := make(map[string]bool)
+	originals := make(map[string]string)
+	for _, t := range templates {
+		files, err := m.templates.TemplateFiles(t.Installpath)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, rel := range files {
+			excluded[t.target(rel)] = true
+			backup, ok, err := m.templates.TemplateBackup(t.Installpath, v, rel)
+			if err != nil {
+				return nil, nil, err
+			}
+			if ok {
+				originals[t.target(rel)] = backup
+			}
+		}
+		// directories created by templates are created again on
+		// import, but may contain other files
+		for _, d := range t.Created[v.String()] {
+			created[d] = true
+		}
+	}
+
+	var res []string
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if excluded[rel] {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if created[rel] {
+			return nil
+		}
+		res = append(res, rel)
+		return nil
+	})
+	for rel := range originals {
+		res = append(res, rel)
+	}
+	return res, originals, err
+}
+
+func (m *SymlinkWebotsManager) Export(v WebotsVersion, w io.Writer) error {
+	if err := m.tryRLock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+
+	if m.isInstalled(v) == false {
+		return fmt.Errorf("Version %s is not installed", v)
+	}
+
+	arch, err := webotsArch()
+	if err != nil {
+		return err
+	}
+
+	root := path.Join(m.workpath, v.String())
+	manifest := BundleManifest{
+		Version:   v.String(),
+		Arch:      arch,
+		Created:   time.Now(),
+		Templates: m.templates.TemplatesFor(v),
+	}
+
+	files, originals, err := m.bundleFiles(v, manifest.Templates)
+	if err != nil {
+		return err
+	}
+	source := func(rel string) string {
+		if p, ok := originals[rel]; ok {
+			return p
+		}
+		return path.Join(root, rel)
+	}
+
+	for _, rel := range files {
+		fi, err := os.Lstat(source(rel))
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() == false {
+			continue
+		}
+		h, err := hashFile(source(rel))
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, ManifestEntry{
+			Path:   rel,
+			Size:   fi.Size(),
+			Mode:   fi.Mode(),
+			Sha256: h,
+		})
+	}
+
+	tw := tar.NewWriter(w)
+
+	manifestData, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeTarBuffer(tw, bundleManifestName, manifestData, 0644)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Exporting %d files of %s", len(files), v)
+	for _, rel := range files {
+		p := source(rel)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+		}
+		h, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		h.Name = bundleTreePrefix + rel
+		if fi.IsDir() {
+			h.Name += "/"
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() == false {
+			continue
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, t := range manifest.Templates {
+		files, err := m.templates.TemplateFiles(t.Installpath)
+		if err != nil {
+			return err
+		}
+		for _, rel := range files {
+			f, err := m.templateData(t, rel)
+			if err != nil {
+				return err
+			}
+			err = writeTarBuffer(tw, bundleTemplatePrefix+path.Join(t.Datapath, rel), f.data, f.mode)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+func writeTarBuffer(tw *tar.Writer, name string, data []byte, mode os.FileMode) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     int64(mode),
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// Import installs a version from a bundle created by Export, and
+// registers its templates. An already installed version is only
+// replaced if force is true.
+func (m *SymlinkWebotsManager) Import(r io.Reader, force bool) (WebotsVersion, error) {
+	if err := m.tryLock(); err != nil {
+		return WebotsVersion{}, err
+	}
+	defer m.unlock()
+
+	tr := tar.NewReader(r)
+	h, err := tr.Next()
+	if err != nil {
+		return WebotsVersion{}, fmt.Errorf("Invalid bundle: %s", err)
+	}
+	if h.Name != bundleManifestName {
+		return WebotsVersion{}, fmt.Errorf("Invalid bundle, first entry is %s instead of %s", h.Name, bundleManifestName)
+	}
+	manifest := BundleManifest{}
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return WebotsVersion{}, fmt.Errorf("Invalid bundle manifest: %s", err)
+	}
+
+	v, err := ParseWebotsVersion(manifest.Version)
+	if err != nil {
+		return WebotsVersion{}, err
+	}
+	arch, err := webotsArch()
+	if err != nil {
+		return WebotsVersion{}, err
+	}
+	if manifest.Arch != arch {
+		return WebotsVersion{}, fmt.Errorf("Bundle of %s is for %s, not %s", v, manifest.Arch, arch)
+	}
+	if m.isInstalled(v) && force == false {
+		return WebotsVersion{}, fmt.Errorf("Version %s is already installed", v)
+	}
+
+	expected := make(map[string]ManifestEntry)
+	for _, e := range manifest.Files {
+		expected[e.Path] = e
+	}
+	templateData := make(map[string]bundleFile)
+
+	// the tree is extracted aside, and only replaces an installed
+	// version once the whole bundle is verified
+	tmp, err := m.extractionDir()
+	if err != nil {
+		return v, err
+	}
+	defer os.RemoveAll(tmp)
+
+	log.Printf("Importing %s from bundle created on %s", v, manifest.Created.Format(time.RFC1123))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return v, err
+		}
+
+		if strings.HasPrefix(h.Name, bundleTemplatePrefix) {
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return v, err
+			}
+			templateData[strings.TrimPrefix(h.Name, bundleTemplatePrefix)] = bundleFile{
+				data: data,
+				mode: h.FileInfo().Mode().Perm(),
+			}
+			continue
+		}
+
+		if strings.HasPrefix(h.Name, bundleTreePrefix) == false {
+			return v, fmt.Errorf("Invalid bundle entry %s", h.Name)
+		}
+
+		rel, err := archiveEntryPath(h)
+		if err != nil {
+			return v, fmt.Errorf("Invalid bundle: %s", err)
+		}
+		isFile := h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeRegA
+		e, ok := expected[rel]
+		if isFile && ok == false {
+			return v, fmt.Errorf("Bundle file %s is not listed in manifest", rel)
+		}
+		hash := sha256.New()
+		err = extractFile(tmp, h, io.TeeReader(tr, hash))
+		if err != nil {
+			return v, fmt.Errorf("Cannot extract %s: %s", h.Name, err)
+		}
+		if isFile == false {
+			continue
+		}
+		if sum := fmt.Sprintf("%x", hash.Sum(nil)); sum != e.Sha256 {
+			return v, fmt.Errorf("Corrupted bundle, %s has checksum %s instead of %s", rel, sum, e.Sha256)
+		}
+		delete(expected, rel)
+	}
+
+	if len(expected) != 0 {
+		missing := make([]string, 0, len(expected))
+		for p := range expected {
+			missing = append(missing, p)
+		}
+		sort.Strings(missing)
+		return v, fmt.Errorf("Incomplete bundle, missing %s", strings.Join(missing, ", "))
+	}
+
+	// templates are only registered once the version is in place, so a
+	// failed import leaves nothing behind
+	templateFiles := make([]map[string]bundleFile, len(manifest.Templates))
+	for i, t := range manifest.Templates {
+		files := make(map[string]bundleFile)
+		for name, f := range templateData {
+			if name == t.Datapath && t.Directory == false {
+				files[""] = f
+			} else if strings.HasPrefix(name, t.Datapath+"/") && t.Directory {
+				files[strings.TrimPrefix(name, t.Datapath+"/")] = f
+			}
+		}
+		if len(files) == 0 {
+			return v, fmt.Errorf("Incomplete bundle, missing template %s", t.Installpath)
+		}
+		templateFiles[i] = files
+	}
+
+	if err := m.replaceVersion(v, tmp); err != nil {
+		return v, err
+	}
+	if m.isInstalled(v) == false {
+		m.installed = append(m.installed, v)
+		sort.Sort(&m.installed)
+	}
+	m.installedChanged()
+
+	for i, t := range manifest.Templates {
+		if err := m.importTemplate(t, templateFiles[i]); err != nil {
+			return v, err
+		}
+	}
+
+	// imported templates may also apply to other installed versions
+	log.Printf("Installing templates")
+	if err := m.ApplyAllTemplates(); err != nil {
+		return v, err
+	}
+	log.Printf("Successfuly imported %s", v)
+	return v, nil
+}
+
+// bundleFile is the content of a template file in a bundle
+type bundleFile struct {
+	data []byte
+	mode os.FileMode
+}
+
+func (m *SymlinkWebotsManager) templateData(t Template, rel string) (bundleFile, error) {
+	r, fi, err := m.templates.TemplateData(t.Installpath, rel)
+	if err != nil {
+		return bundleFile{}, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	return bundleFile{data: data, mode: fi.Mode().Perm()}, err
+}
+
+// importTemplate registers a template from a bundle, with the content
+// of its files. Templates already registered with the same content are
+// kept as is.
+func (m *SymlinkWebotsManager) importTemplate(t Template, files map[string]bundleFile) error {
+	if existing, err := m.templates.TemplateFiles(t.Installpath); err == nil {
+		same := len(existing) == len(files)
+		for _, rel := range existing {
+			data, err := m.templateData(t, rel)
+			if err != nil {
+				return err
+			}
+			same = same && bytes.Equal(data.data, files[rel].data)
+		}
+		if same == false {
+			log.Printf("Keeping local template %s, it differs from the bundled one", t.Installpath)
+		}
+		return nil
+	}
+
+	tmp, err := ioutil.TempDir("", "webots-manager-template")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	source := path.Join(tmp, "data")
+	for rel, f := range files {
+		p := path.Join(source, rel)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, f.data, f.mode); err != nil {
+			return err
+		}
+		// WriteFile mode is masked by the umask
+		if err := os.Chmod(p, f.mode); err != nil {
+			return err
+		}
+	}
+
+	if err := m.templates.RegisterTemplate(source, t.Installpath); err != nil {
+		return err
+	}
+
+	var white, black []VersionConstraint
+	for s := range t.Whitelist {
+		c, err := ParseVersionConstraint(s)
+		if err != nil {
+			return err
+		}
+		white = append(white, c)
+	}
+	for s := range t.Blacklist {
+		c, err := ParseVersionConstraint(s)
+		if err != nil {
+			return err
+		}
+		black = append(black, c)
+	}
+	if err := m.templates.WhiteList(t.Installpath, white); err != nil {
+		return err
+	}
+	if err := m.templates.BlackList(t.Installpath, black); err != nil {
+		return err
+	}
+	if t.Rendered {
+		if err := m.templates.Render(t.Installpath, t.Variables); err != nil {
+			return err
+		}
+	}
+	if t.Copied {
+		if err := m.templates.Copy(t.Installpath); err != nil {
+			return err
+		}
+	}
+	if t.Override {
+		if err := m.templates.Override(t.Installpath); err != nil {
+			return err
+		}
+	}
+	if t.Patched {
+		if err := m.templates.Patch(t.Installpath); err != nil {
+			return err
+		}
+	}
+	log.Printf("Registered template %s", t.Installpath)
+	return nil
+}
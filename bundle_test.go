@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEntry struct {
+	name, link, content string
+}
+
+func testBundle(t *testing.T, version string, templates []Template, entries []testEntry) []byte {
+	arch, err := webotsArch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := BundleManifest{Version: version, Arch: arch, Created: time.Now(), Templates: templates}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	data, err := json.Marshal(&manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTarBuffer(tw, bundleManifestName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: 0644, ModTime: time.Now(), Typeflag: tar.TypeReg, Size: int64(len(e.content))}
+		if len(e.link) != 0 {
+			h.Typeflag, h.Linkname, h.Size = tar.TypeSymlink, e.link, 0
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestArchiveEntryPath(t *testing.T) {
+	testdata := []struct {
+		name, link, expected string
+	}{
+		{"webots/lib/libfoo.so", "", "lib/libfoo.so"},
+		{"webots/", "", "."},
+		{"webots/lib/../bin/webots", "", "bin/webots"},
+		{"webots/lib/libfoo.so", "libfoo.so.1", "lib/libfoo.so"},
+		{"webots/lib/libfoo.so", "../bin/foo", "lib/libfoo.so"},
+		{"webots/../evil", "", ""},
+		{"webots/lib/../../evil", "", ""},
+		{"/etc/evil", "", ""},
+		{"webots/lib/evil", "/etc/passwd", ""},
+		{"webots/lib/evil", "../../etc", ""},
+		{"webots/evil", "..", ""},
+	}
+
+	for _, d := range testdata {
+		typeflag := byte(tar.TypeReg)
+		if len(d.link) != 0 {
+			typeflag = tar.TypeSymlink
+		}
+		rel, err := archiveEntryPath(&tar.Header{Name: d.name, Linkname: d.link, Typeflag: typeflag})
+		if len(d.expected) == 0 {
+			if err == nil {
+				t.Errorf("%s -> %q should be rejected, got %s", d.name, d.link, rel)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", d.name, err)
+		} else if rel != d.expected {
+			t.Errorf("Expected %s for %s, got %s", d.expected, d.name, rel)
+		}
+	}
+}
+
+func TestImportRejectsEscapes(t *testing.T) {
+	testdata := [][]testEntry{
+		{{name: "webots/../escaped", content: "evil"}},
+		{{name: "webots/conf/../../../escaped", content: "evil"}},
+		{{name: "webots/conf", link: "../.."}},
+		{{name: "webots/conf", link: "/"}},
+		// writing through a link is prevented by rejecting the link
+		{{name: "webots/conf", link: ".."}, {name: "webots/conf/escaped", content: "evil"}},
+	}
+
+	for i, entries := range testdata {
+		m, cleanup := newTestManager(t)
+		defer cleanup()
+
+		_, err := m.Import(bytes.NewReader(testBundle(t, "8.5.4", nil, entries)), false)
+		if err == nil {
+			t.Errorf("Bundle %d should be rejected", i)
+		}
+		left, err := ioutil.ReadDir(m.workpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fi := range left {
+			if fi.Name() == "8.5.4" || strings.HasPrefix(fi.Name(), extractionPrefix) {
+				t.Errorf("Bundle %d left %s in the store", i, fi.Name())
+			}
+		}
+		if _, err := os.Lstat(path.Join(m.basepath, "escaped")); err == nil {
+			t.Errorf("Bundle %d wrote outside of the store", i)
+		}
+	}
+}
+
+func TestImportKeepsInstalledVersionOnError(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	installed := path.Join(m.workpath, "8.5.4", "webots")
+	if err := os.MkdirAll(path.Dir(installed), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(installed, []byte("installed"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// webots/webots is not listed in the manifest
+	templates := []Template{{Installpath: "conf/a.ini", Datapath: "a.data"}}
+	bundle := testBundle(t, "8.5.4", templates, []testEntry{
+		{name: "templates/a.data", content: "template"},
+		{name: "webots/webots", content: "imported"},
+	})
+	if _, err := m.Import(bytes.NewReader(bundle), true); err == nil {
+		t.Fatal("Bundle with unlisted files should be rejected")
+	}
+	v, err := ParseWebotsVersion("8.5.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.templates.TemplatesFor(v)) != 0 {
+		t.Errorf("Template of a rejected bundle was registered")
+	}
+	content, err := ioutil.ReadFile(installed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "installed" {
+		t.Errorf("Installed version was modified, content is %q", content)
+	}
+}
+
+func TestExportImportTemplates(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	v, err := ParseWebotsVersion("8.5.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestTree(t, path.Join(m.workpath, v.String()), map[string]string{"bin/webots": "webots"})
+	writeTestTree(t, m.basepath, map[string]string{"script.sh": "#!/bin/sh\n"})
+	if err := os.Chmod(path.Join(m.basepath, "script.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.templates.RegisterTemplate(path.Join(m.basepath, "script.sh"), "bin/script.sh"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.listInstalled(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := m.Export(v, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the imported template also applies to the versions already there
+	imported, cleanupImported := newTestManager(t)
+	defer cleanupImported()
+	writeTestTree(t, path.Join(imported.workpath, "8.6.0"), map[string]string{"bin/webots": "webots"})
+	if err := imported.listInstalled(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := imported.Import(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []string{v.String(), "8.6.0"} {
+		data, err := ioutil.ReadFile(path.Join(imported.workpath, version, "bin/script.sh"))
+		if err != nil {
+			t.Errorf("Template is not installed in %s: %s", version, err)
+		} else if string(data) != "#!/bin/sh\n" {
+			t.Errorf("Unexpected template content %q in %s", data, version)
+		}
+		fi, err := os.Stat(path.Join(imported.workpath, version, "bin/script.sh"))
+		if err == nil && fi.Mode().Perm() != 0755 {
+			t.Errorf("Imported template has mode %s instead of %s in %s", fi.Mode().Perm(), os.FileMode(0755), version)
+		}
+	}
+}
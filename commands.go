@@ -1,18 +1,26 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
 )
 
 type ListCommand struct {
 	All bool `short:"a" long:"available" description:"also prints all available version for installation"`
 }
 
-type InitCommand struct{}
+type InitCommand struct {
+	Adopt bool `long:"adopt" description:"adopt an existing manual installation of webots as a managed version"`
+}
 
 type InstallCommand struct {
-	Use bool `short:"u" long:"use" description:"force use of this new version after installation"`
+	Use   bool `short:"u" long:"use" description:"force use of this new version after installation"`
+	Dedup bool `short:"d" long:"dedup" description:"hardlinks files identical to other installed versions after installation"`
 }
 
 type UseCommand struct{}
@@ -24,14 +32,22 @@ type Interactor struct {
 }
 
 func NewInteractor() (*Interactor, error) {
-	res := &Interactor{}
-	var err error
-	res.archive, err = NewWebotsHttpArchive("http://www.cyberbotics.com/archive/")
-	if err != nil {
-		return nil, err
+	return newInteractor(true)
+}
+
+// NewEnvInteractor returns an Interactor for commands that set up
+// their own environment, and do not require WEBOTS_HOME to point to
+// the used version.
+func NewEnvInteractor() (*Interactor, error) {
+	return newInteractor(false)
+}
+
+func newInteractor(checkWebotsHome bool) (*Interactor, error) {
+	res := &Interactor{
+		archive: NewLazyWebotsArchive(newArchiveFromOptions),
 	}
 
-	manager, err := NewSymlinkManager(res.archive)
+	manager, err := NewSymlinkManager(res.archive, checkWebotsHome)
 	if err != nil {
 		return nil, err
 	}
@@ -41,6 +57,38 @@ func NewInteractor() (*Interactor, error) {
 	return res, nil
 }
 
+// newArchiveFromOptions loads all configured archives. Unreachable
+// archives are skipped as long as one of them can be used.
+func newArchiveFromOptions() (WebotsArchive, error) {
+	if len(options.Archives) == 0 {
+		return nil, fmt.Errorf("No archive configured")
+	}
+	var archives []WebotsArchive
+	var firstErr error
+	for _, u := range options.Archives {
+		a, err := NewWebotsHttpArchive(u)
+		if err != nil {
+			log.Printf("Could not load archive %s: %s", u, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		archives = append(archives, a)
+	}
+	if len(archives) == 0 {
+		return nil, firstErr
+	}
+	var res WebotsArchive = archives[0]
+	if len(archives) > 1 {
+		res = NewMultiWebotsArchive(archives...)
+	}
+	if err := cacheAvailableVersions(res.AvailableVersions()); err != nil {
+		log.Printf("Could not cache available versions: %s", err)
+	}
+	return res, nil
+}
+
 func (x *ListCommand) Execute(args []string) error {
 	xx, err := NewInteractor()
 	if err != nil {
@@ -76,7 +124,13 @@ func (x *ListCommand) Execute(args []string) error {
 }
 
 func (x *InitCommand) Execute(args []string) error {
-	return SymlinkManagerSystemInit()
+	if options.User {
+		if x.Adopt {
+			return fmt.Errorf("Cannot adopt a system installation in a per-user store")
+		}
+		return UserManagerInit()
+	}
+	return SymlinkManagerSystemInit(x.Adopt)
 }
 
 func (x *InstallCommand) Execute(args []string) error {
@@ -99,6 +153,14 @@ func (x *InstallCommand) Execute(args []string) error {
 		return err
 	}
 
+	if x.Dedup {
+		stats, err := xx.manager.Dedup([]WebotsVersion{v}, false)
+		if err != nil {
+			return err
+		}
+		log.Printf("Hardlinked %d files, saved %s", stats.Linked, humanSize(stats.Saved))
+	}
+
 	notUsed := true
 	for _, vv := range xx.manager.Installed() {
 		if xx.manager.IsUsed(vv) {
@@ -114,9 +176,39 @@ func (x *InstallCommand) Execute(args []string) error {
 		}
 		log.Printf("Using now version %s", v)
 	}
+
+	if options.Keep > 0 {
+		removed, err := xx.manager.Prune(options.Keep)
+		if err != nil {
+			return err
+		}
+		for _, r := range removed {
+			log.Printf("Removed old version %s", r)
+		}
+	}
 	return nil
 }
 
+type UninstallCommand struct{}
+
+func (x *UninstallCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Missing version to uninstall")
+	}
+
+	v, err := ParseWebotsVersion(args[0])
+	if err != nil {
+		return err
+	}
+
+	xx, err := NewInteractor()
+	if err != nil {
+		return err
+	}
+
+	return xx.manager.Uninstall(v)
+}
+
 func (x *UseCommand) Execute(args []string) error {
 	if len(args) != 1 {
 		return fmt.Errorf("Missing version to use")
@@ -136,30 +228,42 @@ func (x *UseCommand) Execute(args []string) error {
 }
 
 type AddTemplateCommand struct {
-	Only   []string `short:"o" long:"only" description:"apply template only for these versions"`
-	Except []string `short:"e" long:"except" description:"do not apply template on these versions"`
+	Only     []string          `short:"o" long:"only" description:"apply template only for versions matching these constraints, like 8.5.4, 8.4.*, >=8.5 or >=8.4,<8.6"`
+	Except   []string          `short:"e" long:"except" description:"do not apply template on versions matching these constraints"`
+	Copy     bool              `short:"c" long:"copy" description:"install copies of the file instead of symlinks"`
+	Render   bool              `short:"r" long:"render" description:"render the file as a Go text/template for each version, with .Version, .Major, .Minor, .Patch, .Home, .Arch, .Hostname and .Vars"`
+	Vars     map[string]string `short:"V" long:"var" description:"variable KEY:VALUE available as .Vars.KEY in a rendered template, can be repeated"`
+	Override bool              `long:"override" description:"replace files shipped with webots, which are backed up and restored when the template is removed"`
+	Patch    bool              `short:"p" long:"patch" description:"the file is a unified diff, applied to the file shipped with each version and reverted when the template is removed"`
+	Profiles []string          `short:"P" long:"profile" description:"adds the template to this profile, created if needed, can be repeated"`
 }
 
-func (x *AddTemplateCommand) Execute(args []string) error {
+func (x *AddTemplateCommand) Execute(args []string) (err error) {
 	if len(args) != 2 {
 		return fmt.Errorf("Need file to read and where to install")
 	}
+	if len(x.Vars) != 0 && x.Render == false {
+		return fmt.Errorf("Variables can only be used with --render")
+	}
+	if x.Patch && (x.Render || x.Copy || x.Override) {
+		return fmt.Errorf("--patch cannot be used with --render, --copy or --override")
+	}
 
-	var white, black []WebotsVersion
+	var white, black []VersionConstraint
 	for _, w := range x.Only {
-		v, err := ParseWebotsVersion(w)
+		c, err := ParseVersionConstraint(w)
 		if err != nil {
 			return err
 		}
-		white = append(white, v)
+		white = append(white, c)
 	}
 
 	for _, w := range x.Except {
-		v, err := ParseWebotsVersion(w)
+		c, err := ParseVersionConstraint(w)
 		if err != nil {
 			return err
 		}
-		black = append(black, v)
+		black = append(black, c)
 	}
 
 	xx, err := NewInteractor()
@@ -172,6 +276,22 @@ func (x *AddTemplateCommand) Execute(args []string) error {
 		return err
 	}
 
+	// on failure, the template is removed so it can be added again,
+	// e.g. with --override
+	applied := false
+	defer func() {
+		if err == nil {
+			return
+		}
+		remove := xx.templates.RemoveTemplate
+		if applied {
+			remove = xx.removeTemplate
+		}
+		if rerr := remove(args[1]); rerr != nil {
+			log.Printf("Could not remove template %s: %s", args[1], rerr)
+		}
+	}()
+
 	err = xx.templates.WhiteList(args[1], white)
 	if err != nil {
 		return err
@@ -180,7 +300,38 @@ func (x *AddTemplateCommand) Execute(args []string) error {
 	if err != nil {
 		return err
 	}
+	if x.Render {
+		err = xx.templates.Render(args[1], x.Vars)
+		if err != nil {
+			return err
+		}
+	}
+	if x.Copy {
+		err = xx.templates.Copy(args[1])
+		if err != nil {
+			return err
+		}
+	}
+	if x.Override {
+		err = xx.templates.Override(args[1])
+		if err != nil {
+			return err
+		}
+	}
+	if x.Patch {
+		err = xx.templates.Patch(args[1])
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range x.Profiles {
+		err = xx.templates.AddToProfile(p, []string{args[1]})
+		if err != nil {
+			return err
+		}
+	}
 
+	applied = true
 	return xx.manager.ApplyAllTemplates()
 }
 
@@ -196,43 +347,1074 @@ func (x *RemoveTemplateCommand) Execute(args []string) error {
 		return err
 	}
 
-	err = xx.templates.RemoveTemplate(args[0])
+	return xx.removeTemplate(args[0])
+}
+
+// removeTemplate removes a template and the files it installed
+func (xx *Interactor) removeTemplate(installpath string) error {
+	// blacklisting all versions removes exactly what the template
+	// installed
+	var all []VersionConstraint
+	for _, v := range xx.manager.Installed() {
+		all = append(all, ExactVersionConstraint(v))
+	}
+	err := xx.templates.BlackList(installpath, all)
+	if err != nil {
+		return err
+	}
+	err = xx.manager.ApplyAllTemplates()
 	if err != nil {
 		return err
 	}
 
-	return xx.manager.ApplyAllTemplates()
+	return xx.templates.RemoveTemplate(installpath)
 }
 
-func init() {
-	parser.AddCommand("list",
-		"Prints all the available version of webots",
-		"Prints all installed version, and current version in use. Can also prinst all available version for installation",
-		&ListCommand{})
+type UpdateTemplateCommand struct{}
 
-	parser.AddCommand("init",
-		"Initialiaze the system for webots_manager",
-		"Initialiaze the system with all requirement for webots_manager",
-		&InitCommand{})
+func (x *UpdateTemplateCommand) Execute(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Need file to update template with and install path")
+	}
 
-	parser.AddCommand("install",
-		"Install a new webots version on the system",
-		"Installs a new webots version on the system",
-		&InstallCommand{})
+	xx, err := NewInteractor()
+	if err != nil {
+		return err
+	}
 
-	parser.AddCommand("use",
-		"Use a webots version on the system",
-		"Use a webots version on the system. If it is not installed, it will first install it",
-		&UseCommand{})
+	err = xx.templates.UpdateTemplate(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	err = xx.manager.ApplyAllTemplates()
+	if err != nil {
+		return err
+	}
 
-	parser.AddCommand("add-template",
-		"Adds a template file to all version",
-		"Install a file to all version of webots. -o and -e can be used to explicitely whitelist or blacklist a version",
-		&AddTemplateCommand{})
+	// previous content is only removed once nothing points to it anymore
+	return xx.templates.CollectGarbage()
+}
 
-	parser.AddCommand("remove-template",
-		"Removes a template file from all version",
-		"Removes a previously installed template from all version of webots.",
-		&RemoveTemplateCommand{})
+type ListTemplatesCommand struct {
+	Json bool `long:"json" description:"prints the templates as JSON"`
+}
+
+func (x *ListTemplatesCommand) Execute(args []string) error {
+	// the WEBOTS_HOME warning would make the JSON invalid
+	xx, err := newInteractor(x.Json == false)
+	if err != nil {
+		return err
+	}
+
+	templates, err := xx.manager.ListTemplates()
+	if err != nil {
+		return err
+	}
+	if x.Json {
+		if templates == nil {
+			templates = []TemplateListing{}
+		}
+		data, err := json.MarshalIndent(templates, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", data)
+		return nil
+	}
+	if len(templates) == 0 {
+		fmt.Printf("No template registered.\n")
+		return nil
+	}
+
+	for _, t := range templates {
+		kind := "link"
+		if t.Rendered {
+			kind = "rendered"
+		} else if t.Copied {
+			kind = "copy"
+		}
+		if t.Directory {
+			kind = fmt.Sprintf("directory of %d files, %s", t.Files, kind)
+		}
+		if t.Override {
+			kind += ", override"
+		}
+		if t.Patched {
+			kind = "patch"
+		}
+		fmt.Printf("%s (%s, %s)\n", t.Installpath, kind, humanSize(t.Size))
+		fmt.Printf("  hash: %s\n", t.Hash)
+		if len(t.Whitelist) != 0 {
+			fmt.Printf("  only: %s\n", strings.Join(t.Whitelist, ", "))
+		}
+		if len(t.Blacklist) != 0 {
+			fmt.Printf("  except: %s\n", strings.Join(t.Blacklist, ", "))
+		}
+		if len(t.Profiles) != 0 {
+			disabled := ""
+			if t.Disabled {
+				disabled = " (all disabled)"
+			}
+			fmt.Printf("  profiles: %s%s\n", strings.Join(t.Profiles, ", "), disabled)
+		}
+		for _, p := range t.Versions {
+			status := ""
+			switch {
+			case p.Expected && p.Present:
+				status = "present"
+			case p.Expected:
+				status = "missing, should be present"
+			case p.Present:
+				status = "extraneous, should not be present"
+			default:
+				status = "absent"
+			}
+			switch p.Patch {
+			case PatchClean:
+				status += ", patch applied cleanly"
+			case PatchFuzz:
+				status += ", patch applied with fuzz"
+			case PatchFailed:
+				status = "patch failed, file left untouched"
+			}
+			fmt.Printf("  %-10s %s\n", p.Version, status)
+		}
+	}
+	return nil
+}
+
+type DuCommand struct{}
+
+func (x *DuCommand) Execute(args []string) error {
+	xx, err := NewInteractor()
+	if err != nil {
+		return err
+	}
+
+	report, err := xx.manager.DiskUsage()
+	if err != nil {
+		return err
+	}
+	if len(report.Versions) == 0 {
+		fmt.Printf("No webots version installed.\n")
+		return nil
+	}
+
+	fmt.Printf(" %-10s %12s %12s %12s\n", "Version", "Size", "Unique", "Shared")
+	for _, u := range report.Versions {
+		fmt.Printf(" %-10s %12s %12s %12s\n",
+			u.Version,
+			humanSize(u.Apparent),
+			humanSize(u.Unique),
+			humanSize(u.Shared))
+	}
+	fmt.Printf("Total on disk: %s (%s without hardlinks, %s shared between versions)\n",
+		humanSize(report.Total),
+		humanSize(report.Apparent),
+		humanSize(report.Shared))
+	return nil
+}
+
+type DedupCommand struct {
+	DryRun bool `short:"n" long:"dry-run" description:"only prints what would be hardlinked"`
+}
+
+func (x *DedupCommand) Execute(args []string) error {
+	var only []WebotsVersion
+	for _, a := range args {
+		v, err := ParseWebotsVersion(a)
+		if err != nil {
+			return err
+		}
+		only = append(only, v)
+	}
+
+	xx, err := NewInteractor()
+	if err != nil {
+		return err
+	}
+
+	stats, err := xx.manager.Dedup(only, x.DryRun)
+	if err != nil {
+		return err
+	}
+
+	if x.DryRun {
+		fmt.Printf("Would hardlink %d files, saving %s\n", stats.Linked, humanSize(stats.Saved))
+	} else {
+		fmt.Printf("Hardlinked %d files, saved %s\n", stats.Linked, humanSize(stats.Saved))
+	}
+	return nil
+}
+
+type HistoryCommand struct {
+	Last int `short:"n" long:"last" description:"only prints the last N switches"`
+}
+
+func (x *HistoryCommand) Execute(args []string) error {
+	xx, err := NewInteractor()
+	if err != nil {
+		return err
+	}
+
+	h, err := xx.manager.History()
+	if err != nil {
+		return err
+	}
+	if len(h) == 0 {
+		fmt.Printf("No version switch recorded.\n")
+		return nil
+	}
+
+	first := 0
+	if x.Last > 0 && x.Last < len(h) {
+		first = len(h) - x.Last
+	}
+	for i := first; i < len(h); i++ {
+		r := h[i]
+		from := r.From
+		if len(from) == 0 {
+			from = "none"
+		}
+		fmt.Printf(" %3d  %s  %-12s %s -> %s\n",
+			len(h)-i,
+			r.Time.Format("2006-01-02 15:04:05"),
+			r.User,
+			from,
+			r.To)
+	}
+	return nil
+}
+
+type RollbackCommand struct{}
+
+func (x *RollbackCommand) Execute(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Too many arguments")
+	}
+	steps := 1
+	if len(args) == 1 {
+		var err error
+		steps, err = strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("Invalid number of steps %s: %s", args[0], err)
+		}
+	}
+
+	xx, err := NewInteractor()
+	if err != nil {
+		return err
+	}
+
+	v, err := xx.manager.Rollback(steps)
+	if err != nil {
+		return err
+	}
+	log.Printf("Using now version %s", v)
+	return nil
+}
+
+type ExportCommand struct {
+	Output string `short:"o" long:"output" description:"bundle file to write" required:"true"`
+}
+
+func (x *ExportCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Missing version to export")
+	}
+
+	v, err := ParseWebotsVersion(args[0])
+	if err != nil {
+		return err
+	}
+
+	xx, err := NewInteractor()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(x.Output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = xx.manager.Export(v, f)
+	if err != nil {
+		os.Remove(x.Output)
+		return err
+	}
+	log.Printf("Exported %s to %s", v, x.Output)
+	return nil
+}
+
+type ImportCommand struct {
+	Use   bool `short:"u" long:"use" description:"use the imported version"`
+	Force bool `short:"f" long:"force" description:"replace the version if it is already installed"`
+}
+
+func (x *ImportCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Missing bundle to import")
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	xx, err := NewInteractor()
+	if err != nil {
+		return err
+	}
+
+	v, err := xx.manager.Import(f, x.Force)
+	if err != nil {
+		return err
+	}
+
+	if x.Use {
+		err = xx.manager.Use(v)
+		if err != nil {
+			return err
+		}
+		log.Printf("Using now version %s", v)
+	}
+	return nil
+}
+
+type EnvCommand struct {
+	Shell string `short:"s" long:"shell" description:"shell syntax to use: bash, zsh or fish. Defaults to the login shell"`
+}
+
+func (x *EnvCommand) Execute(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Too many arguments")
+	}
+
+	shell, err := detectShell(x.Shell)
+	if err != nil {
+		return err
+	}
+
+	var v *WebotsVersion
+	if len(args) == 1 {
+		vv, err := ParseWebotsVersion(args[0])
+		if err != nil {
+			return err
+		}
+		v = &vv
+	}
+
+	xx, err := NewEnvInteractor()
+	if err != nil {
+		return err
+	}
+
+	vars, err := xx.manager.Env(v)
+	if err != nil {
+		return err
+	}
+	fmt.Print(formatEnv(shell, vars))
+	return nil
+}
+
+type ExecCommand struct {
+	Install bool `short:"i" long:"install" description:"install the version first if it is missing"`
+}
+
+func (x *ExecCommand) Execute(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("Need a version and a command to run")
+	}
+
+	v, err := ParseWebotsVersion(args[0])
+	if err != nil {
+		return err
+	}
+
+	xx, err := NewEnvInteractor()
+	if err != nil {
+		return err
+	}
+
+	installed := false
+	for _, vv := range xx.manager.Installed() {
+		if vv == v {
+			installed = true
+			break
+		}
+	}
+	if installed == false && x.Install {
+		err = xx.manager.Install(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	vars, err := xx.manager.Env(&v)
+	if err != nil {
+		return err
+	}
+
+	// on success, exit code is the one of the command
+	return execWithEnv(vars, args[1:])
+}
+
+type RehashCommand struct{}
+
+func (x *RehashCommand) Execute(args []string) error {
+	xx, err := NewEnvInteractor()
+	if err != nil {
+		return err
+	}
+
+	names, err := xx.manager.Rehash()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Generated shims: %s\n", strings.Join(names, ", "))
+	return nil
+}
+
+type ShimExecCommand struct{}
+
+func (x *ShimExecCommand) Execute(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Missing executable name")
+	}
+
+	xx, err := NewEnvInteractor()
+	if err != nil {
+		return err
+	}
+
+	return xx.manager.ShimExec(args[0], args[1:])
+}
+
+type PinCommand struct {
+	Personal bool `short:"p" long:"personal" description:"pin the version for the current user instead of the current directory"`
+	Unset    bool `long:"unset" description:"removes the pin"`
+}
+
+func (x *PinCommand) Execute(args []string) error {
+	var v *WebotsVersion
+	if x.Unset == false {
+		if len(args) != 1 {
+			return fmt.Errorf("Missing version to pin")
+		}
+		vv, err := ParseWebotsVersion(args[0])
+		if err != nil {
+			return err
+		}
+		v = &vv
+	}
+
+	p := pinFileName
+	if x.Personal {
+		var err error
+		p, err = userPinPath()
+		if err != nil {
+			return err
+		}
+	}
+	return PinVersion(p, v)
+}
+
+type WhichCommand struct{}
+
+func (x *WhichCommand) Execute(args []string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	spec, source, err := ResolveVersion(wd)
+	if err != nil {
+		return err
+	}
+
+	xx, err := NewEnvInteractor()
+	if err != nil {
+		return err
+	}
+	v, err := resolveSpec(spec, xx.manager.Installed())
+	if err != nil {
+		return fmt.Errorf("%s (required by %s)", err, source)
+	}
+	home, err := xx.manager.Home(v)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		fmt.Printf("%s (%s)\n", home, source)
+	} else {
+		fmt.Printf("%s %s (set by %s)\n", v, home, source)
+	}
+	return nil
+}
+
+type HookCommand struct{}
+
+func (x *HookCommand) Execute(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Too many arguments")
+	}
+	name := ""
+	if len(args) == 1 {
+		name = args[0]
+	}
+	shell, err := detectShell(name)
+	if err != nil {
+		return err
+	}
+	self, err := selfCommand()
+	if err != nil {
+		return err
+	}
+	fmt.Print(hookScript(shell, self))
+	return nil
+}
+
+type HookEnvCommand struct {
+	Shell string `short:"s" long:"shell" description:"shell syntax to use: bash, zsh or fish"`
+}
+
+func (x *HookEnvCommand) Execute(args []string) error {
+	shell, err := detectShell(x.Shell)
+	if err != nil {
+		return err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	xx, err := NewEnvInteractor()
+	if err != nil {
+		return err
+	}
+	vars, warning, err := xx.manager.HookEnv(wd)
+	if err != nil {
+		return err
+	}
+	if len(warning) != 0 {
+		fmt.Fprintln(os.Stderr, warning)
+		return nil
+	}
+	fmt.Print(formatEnv(shell, vars))
+	return nil
+}
+
+type ModulefilesCommand struct{}
+
+type ModulefilesGenerateCommand struct {
+	Format string `short:"f" long:"format" default:"tcl" choice:"tcl" choice:"lua" description:"modulefile format, tcl for Environment Modules or lua for Lmod"`
+}
+
+func (x *ModulefilesGenerateCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Missing directory to generate modulefiles in")
+	}
+
+	xx, err := NewEnvInteractor()
+	if err != nil {
+		return err
+	}
+
+	err = xx.manager.GenerateModulefiles(args[0], x.Format)
+	if err != nil {
+		return err
+	}
+	log.Printf("Generated modulefiles in %s, they will be updated on each installation", args[0])
+	return nil
+}
+
+type ModulefilesForgetCommand struct{}
+
+func (x *ModulefilesForgetCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Missing directory of modulefiles")
+	}
+
+	xx, err := NewEnvInteractor()
+	if err != nil {
+		return err
+	}
+
+	return xx.manager.ForgetModulefiles(args[0])
+}
+
+type DoctorCommand struct {
+	Fix bool `long:"fix" description:"fixes the problems that can be fixed automatically"`
+}
+
+func (x *DoctorCommand) Execute(args []string) error {
+	if x.Fix {
+		unlock, err := LockStore()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	checks, err := Diagnose()
+	if err != nil {
+		return err
+	}
+	remaining := 0
+	for _, c := range checks {
+		if len(c.Problems) == 0 {
+			fmt.Printf("[ok] %s\n", c.Name)
+			continue
+		}
+		for _, p := range c.Problems {
+			fmt.Printf("[!!] %s: %s\n", c.Name, p.Description)
+			if x.Fix && p.Fixable() {
+				if err := p.Fix(); err != nil {
+					fmt.Printf("     could not fix: %s\n", err)
+				} else {
+					fmt.Printf("     fixed\n")
+					continue
+				}
+			}
+			remaining++
+			if len(p.Suggestion) != 0 {
+				fmt.Printf("     fix: %s\n", p.Suggestion)
+			}
+			if x.Fix == false && p.Fixable() {
+				fmt.Printf("     (can be fixed with --fix)\n")
+			}
+		}
+	}
+	if remaining != 0 {
+		return fmt.Errorf("Found %d problem(s)", remaining)
+	}
+	return nil
+}
+
+type ProfileCommand struct{}
+
+type ProfileListCommand struct{}
+
+func (x *ProfileListCommand) Execute(args []string) error {
+	xx, err := NewInteractor()
+	if err != nil {
+		return err
+	}
+
+	profiles := xx.templates.Profiles()
+	if len(profiles) == 0 {
+		fmt.Printf("No profile defined.\n")
+		return nil
+	}
+	for _, p := range profiles {
+		state := "disabled"
+		if p.Enabled {
+			state = "enabled"
+		}
+		fmt.Printf("%s (%s): %s\n", p.Name, state, strings.Join(p.Templates, ", "))
+	}
+	return nil
+}
+
+type ProfileEnableCommand struct{}
+
+func (x *ProfileEnableCommand) Execute(args []string) error {
+	return enableProfile(args, true)
+}
+
+type ProfileDisableCommand struct{}
+
+func (x *ProfileDisableCommand) Execute(args []string) error {
+	return enableProfile(args, false)
+}
+
+func enableProfile(args []string, enabled bool) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Need the name of the profile")
+	}
+
+	xx, err := NewInteractor()
+	if err != nil {
+		return err
+	}
+
+	err = xx.templates.EnableProfile(args[0], enabled)
+	if err != nil {
+		return err
+	}
+	return xx.manager.ApplyAllTemplates()
+}
+
+type ProfileAddCommand struct{}
+
+func (x *ProfileAddCommand) Execute(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("Need the name of the profile and templates to add")
+	}
+
+	xx, err := NewInteractor()
+	if err != nil {
+		return err
+	}
+
+	err = xx.templates.AddToProfile(args[0], args[1:])
+	if err != nil {
+		return err
+	}
+	return xx.manager.ApplyAllTemplates()
+}
+
+type ProfileRemoveCommand struct{}
+
+func (x *ProfileRemoveCommand) Execute(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("Need the name of the profile and templates to remove")
+	}
+
+	xx, err := NewInteractor()
+	if err != nil {
+		return err
+	}
+
+	err = xx.templates.RemoveFromProfile(args[0], args[1:])
+	if err != nil {
+		return err
+	}
+	return xx.manager.ApplyAllTemplates()
+}
+
+type TemplateStatusCommand struct {
+	Fix bool `long:"fix" description:"reconciles installed templates, saving modified files aside with a .orig suffix"`
+}
+
+func (x *TemplateStatusCommand) Execute(args []string) error {
+	xx, err := NewInteractor()
+	if err != nil {
+		return err
+	}
+
+	status, err := xx.manager.TemplateStatus(x.Fix)
+	if err != nil {
+		return err
+	}
+	remaining := 0
+	for _, vd := range status {
+		if len(vd.Drifts) == 0 {
+			fmt.Printf("[ok] %s\n", vd.Version)
+			continue
+		}
+		for _, d := range vd.Drifts {
+			template := ""
+			if len(d.Template) != 0 {
+				template = fmt.Sprintf(" (template %s)", d.Template)
+			}
+			fmt.Printf("[!!] %s: %s %s%s: %s\n", vd.Version, d.Kind, d.Path, template, d.Detail)
+		}
+		if x.Fix == false {
+			remaining += len(vd.Drifts)
+			continue
+		}
+		remaining += len(vd.Remaining)
+		if len(vd.Remaining) == 0 {
+			fmt.Printf("     fixed\n")
+		}
+		for _, d := range vd.Remaining {
+			fmt.Printf("     could not fix %s %s: %s\n", d.Kind, d.Path, d.Detail)
+		}
+	}
+	if remaining != 0 {
+		if x.Fix == false {
+			fmt.Printf("Run with --fix to reconcile them\n")
+		}
+		return fmt.Errorf("Found %d drifted template file(s)", remaining)
+	}
+	return nil
+}
+
+type CompletionCommand struct{}
+
+func (x *CompletionCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Missing shell to complete: %s", strings.Join(supportedShells, ", "))
+	}
+	shell, err := detectShell(args[0])
+	if err != nil {
+		return err
+	}
+	self, err := selfCommand()
+	if err != nil {
+		return err
+	}
+	name := path.Base(os.Args[0])
+	fmt.Print(completionScript(shell, name, self, completionCommands(parser)))
+	return nil
+}
+
+type CompleteCandidatesCommand struct{}
+
+func (x *CompleteCandidatesCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Missing kind of candidates")
+	}
+	candidates, err := completionCandidates(args[0])
+	if err != nil {
+		return err
+	}
+	for _, c := range candidates {
+		fmt.Println(c)
+	}
+	return nil
+}
+
+type ConfigCommand struct {
+	System bool `long:"system" description:"modify the system configuration instead of the user one"`
+}
+
+func (x *ConfigCommand) Execute(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Missing action, use get, set, unset or list")
+	}
+
+	switch args[0] {
+	case "list":
+		for _, o := range configOptions() {
+			for _, v := range formatConfigValue(o.option.Value()) {
+				fmt.Printf("%s = %s  # %s\n", o.key, v, configSource(o))
+			}
+		}
+		return nil
+	case "get":
+		if len(args) != 2 {
+			return fmt.Errorf("Need the key to get")
+		}
+		o, err := findConfigOption(args[1])
+		if err != nil {
+			return err
+		}
+		for _, v := range formatConfigValue(o.option.Value()) {
+			fmt.Println(v)
+		}
+		return nil
+	case "set", "unset":
+		if args[0] == "set" && len(args) < 3 {
+			return fmt.Errorf("Need the key and value(s) to set")
+		}
+		if args[0] == "unset" && len(args) != 2 {
+			return fmt.Errorf("Need the key to unset")
+		}
+		o, err := findConfigOption(args[1])
+		if err != nil {
+			return err
+		}
+		values := args[2:]
+		for _, v := range values {
+			if err := o.option.Set(&v); err != nil {
+				return fmt.Errorf("Invalid value %s for %s: %s", v, o.key, err)
+			}
+		}
+		p := systemConfigPath
+		if x.System == false {
+			p, err = userConfigPath()
+			if err != nil {
+				return err
+			}
+		}
+		return setConfigValue(p, o, values)
+	}
+	return fmt.Errorf("Unknown action %s, use get, set, unset or list", args[0])
+}
+
+func init() {
+	parser.AddCommand("list",
+		"Prints all the available version of webots",
+		"Prints all installed version, and current version in use. Can also prinst all available version for installation",
+		&ListCommand{})
+
+	parser.AddCommand("init",
+		"Initialiaze the system for webots_manager",
+		"Initialiaze the system with all requirement for webots_manager",
+		&InitCommand{})
+
+	parser.AddCommand("install",
+		"Install a new webots version on the system",
+		"Installs a new webots version on the system",
+		&InstallCommand{})
+
+	parser.AddCommand("uninstall",
+		"Removes an installed webots version",
+		"Removes an installed webots version. The version in use cannot be removed",
+		&UninstallCommand{})
+
+	parser.AddCommand("use",
+		"Use a webots version on the system",
+		"Use a webots version on the system. If it is not installed, it will first install it",
+		&UseCommand{})
+
+	parser.AddCommand("add-template",
+		"Adds a template file to all version",
+		"Install a file to all version of webots. -o and -e can be used to explicitely whitelist or blacklist a version",
+		&AddTemplateCommand{})
+
+	parser.AddCommand("remove-template",
+		"Removes a template file from all version",
+		"Removes a previously installed template from all version of webots.",
+		&RemoveTemplateCommand{})
+
+	parser.AddCommand("list-templates",
+		"Lists registered templates",
+		"Lists registered templates with their content hash, size and rules, and for each installed version if they should be and are installed",
+		&ListTemplatesCommand{})
+
+	profile, _ := parser.AddCommand("profile",
+		"Manages template profiles",
+		"Groups templates in named profiles. A template in profiles is only installed if one of them is enabled, templates without profile are always installed",
+		&ProfileCommand{})
+	profile.SubcommandsOptional = false
+
+	profile.AddCommand("list",
+		"Lists profiles",
+		"Lists profiles, if they are enabled, and their templates",
+		&ProfileListCommand{})
+
+	profile.AddCommand("enable",
+		"Enables a profile",
+		"Enables a profile, and installs its templates in all versions",
+		&ProfileEnableCommand{})
+
+	profile.AddCommand("disable",
+		"Disables a profile",
+		"Disables a profile, and removes its templates from all versions, unless they belong to another enabled profile",
+		&ProfileDisableCommand{})
+
+	profile.AddCommand("add",
+		"Adds templates to a profile",
+		"Adds templates, by install path, to a profile. The profile is created enabled if needed",
+		&ProfileAddCommand{})
+
+	profile.AddCommand("remove",
+		"Removes templates from a profile",
+		"Removes templates, by install path, from a profile. The profile is deleted once empty",
+		&ProfileRemoveCommand{})
+
+	parser.AddCommand("template-status",
+		"Checks installed templates",
+		"Compares what templates should install in each version with its files, and reports missing, extraneous, foreign and modified ones. --fix reconciles them",
+		&TemplateStatusCommand{})
+
+	parser.AddCommand("update-template",
+		"Replaces the content of a template",
+		"Replaces the content of a previously added template by a new file or directory, keeping its rules, and updates it in all versions",
+		&UpdateTemplateCommand{})
+
+	parser.AddCommand("du",
+		"Prints disk usage of installed versions",
+		"Prints the size of each installed version, and how much of it is shared with other versions through hardlinks",
+		&DuCommand{})
+
+	parser.AddCommand("dedup",
+		"Hardlinks identical files across versions",
+		"Replaces files identical between installed versions by hardlinks. If versions are given, only their files are replaced",
+		&DedupCommand{})
+
+	parser.AddCommand("history",
+		"Prints the history of used versions",
+		"Prints every switch of the used version, with its date and the user who made it",
+		&HistoryCommand{})
+
+	parser.AddCommand("rollback",
+		"Uses back a previously used version",
+		"Uses back the version in use before the last N switches (default 1), as numbered by the history command",
+		&RollbackCommand{})
+
+	parser.AddCommand("export",
+		"Exports an installed version to a bundle",
+		"Exports an installed version, with the templates that applies to it, to a bundle that can be imported on an offline computer",
+		&ExportCommand{})
+
+	parser.AddCommand("import",
+		"Imports a version from a bundle",
+		"Installs a version and its templates from a bundle created with the export command",
+		&ImportCommand{})
+
+	parser.AddCommand("env",
+		"Prints shell commands to use a version",
+		"Prints the shell exports of WEBOTS_HOME, PATH and LD_LIBRARY_PATH to use a version (or the used one) in the current shell only, e.g. eval \"$(webots-manager env 8.5.4)\"",
+		&EnvCommand{})
+
+	parser.AddCommand("exec",
+		"Runs a command with a version",
+		"Runs a command within the environment of a version, without modifying the used one, e.g. exec 8.5.4 -- make test",
+		&ExecCommand{})
+
+	parser.AddCommand("rehash",
+		"Regenerates the shims",
+		"Regenerates the shims for all executables of installed versions. Shims resolve the version per invocation, from WEBOTS_MANAGER_VERSION, a .webots-version file, the personal pin, then the used version",
+		&RehashCommand{})
+
+	shimExec, _ := parser.AddCommand("shim-exec",
+		"Executes a shim",
+		"Executes the binary of a shim in the resolved version",
+		&ShimExecCommand{})
+	shimExec.Hidden = true
+
+	parser.AddCommand("pin",
+		"Pins a version for the current directory",
+		"Pins a version for the current directory and its subdirectories in a .webots-version file, or for the current user with --personal. Used by shims",
+		&PinCommand{})
+
+	parser.AddCommand("which",
+		"Prints the version resolved by shims",
+		"Prints the version shims would use in the current directory, and what sets it",
+		&WhichCommand{})
+
+	parser.AddCommand("hook",
+		"Prints a shell hook switching version per directory",
+		"Prints the code of a shell hook (bash, zsh or fish) which sets up the version required by the current project (.webots-version or world header) when changing directory, e.g. eval \"$(webots-manager hook bash)\" in your .bashrc",
+		&HookCommand{})
+
+	hookEnv, _ := parser.AddCommand("hook-env",
+		"Prints the environment for the current directory",
+		"Prints the environment for the version required in the current directory, used by the shell hook",
+		&HookEnvCommand{})
+	hookEnv.Hidden = true
+
+	modulefiles, _ := parser.AddCommand("modulefiles",
+		"Manages Environment Modules / Lmod modulefiles",
+		"Generates modulefiles for installed versions, kept in sync with installations",
+		&ModulefilesCommand{})
+	modulefiles.SubcommandsOptional = false
+
+	modulefiles.AddCommand("generate",
+		"Generates modulefiles in a directory",
+		"Generates a modulefile DIR/webots/VERSION for each installed version, and keeps them in sync after each installation or removal",
+		&ModulefilesGenerateCommand{})
+
+	modulefiles.AddCommand("forget",
+		"Stops updating modulefiles of a directory",
+		"Stops updating modulefiles of a directory. Existing modulefiles are kept",
+		&ModulefilesForgetCommand{})
+
+	parser.AddCommand("doctor",
+		"Diagnoses the setup",
+		"Checks the webots-manager group, the symlinks to the used version, the store permissions, WEBOTS_HOME, locks, installed versions, templates and archives, and suggests fixes. Some problems can be fixed with --fix",
+		&DoctorCommand{})
+
+	parser.AddCommand("completion",
+		"Prints a shell completion script",
+		"Prints the completion script for bash, zsh or fish, completing commands, options, versions and templates, e.g. eval \"$(webots-manager completion bash)\" in your .bashrc, or webots-manager completion fish | source",
+		&CompletionCommand{})
+
+	completeCandidates, _ := parser.AddCommand("complete-candidates",
+		"Prints completion candidates",
+		"Prints the installed versions, available versions or templates, used by completion scripts",
+		&CompleteCandidatesCommand{})
+	completeCandidates.Hidden = true
+
+	parser.AddCommand("config",
+		"Reads or modifies the configuration",
+		"Reads or modifies the configuration: config list, config get KEY, config set KEY VALUE..., config unset KEY. Keys are global option names, or COMMAND.OPTION for command options (e.g. install.use)",
+		&ConfigCommand{})
 
 }
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// Completion scripts are generated from the commands and options
+// registered on the parser. Arguments of some commands are completed
+// with live candidates, printed by the hidden complete-candidates
+// command.
+
+const (
+	candidatesInstalled = "installed"
+	candidatesAvailable = "available"
+	candidatesTemplates = "templates"
+	candidatesShells    = "shells"
+	candidatesProfiles  = "profiles"
+
+	availableCacheName = "available-versions"
+)
+
+// commandCandidates are the candidates completing the arguments of a
+// command, by command path.
+var commandCandidates = map[string]string{
+	"use":             candidatesInstalled,
+	"uninstall":       candidatesInstalled,
+	"env":             candidatesInstalled,
+	"exec":            candidatesInstalled,
+	"export":          candidatesInstalled,
+	"install":         candidatesAvailable,
+	"remove-template": candidatesTemplates,
+	"completion":      candidatesShells,
+	"hook":            candidatesShells,
+	"profile enable":  candidatesProfiles,
+	"profile disable": candidatesProfiles,
+}
+
+// availableCachePath returns where the versions found in archives are
+// cached, so completion never waits for the network.
+func availableCachePath() (string, error) {
+	if cacheHome := os.Getenv("XDG_CACHE_HOME"); path.IsAbs(cacheHome) {
+		return path.Join(cacheHome, "webots-manager", availableCacheName), nil
+	}
+	home := os.Getenv("HOME")
+	if path.IsAbs(home) == false {
+		return "", fmt.Errorf("Cannot find user cache directory, neither XDG_CACHE_HOME nor HOME are set")
+	}
+	return path.Join(home, ".cache", "webots-manager", availableCacheName), nil
+}
+
+func cacheAvailableVersions(vers []WebotsVersion) error {
+	p, err := availableCachePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+	lines := make([]string, 0, len(vers))
+	for _, v := range vers {
+		lines = append(lines, v.String()+"\n")
+	}
+	return writeUnshared(p, strings.NewReader(strings.Join(lines, "")), 0644)
+}
+
+func cachedAvailableVersions() ([]WebotsVersion, error) {
+	p, err := availableCachePath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var res []WebotsVersion
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		v, err := ParseWebotsVersion(strings.TrimSpace(scanner.Text()))
+		if err != nil {
+			continue
+		}
+		res = append(res, v)
+	}
+	return res, scanner.Err()
+}
+
+// completionCandidates returns the live candidates of kind
+func completionCandidates(kind string) ([]string, error) {
+	var res []string
+	switch kind {
+	case candidatesAvailable:
+		vers, err := cachedAvailableVersions()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vers {
+			res = append(res, v.String())
+		}
+	case candidatesShells:
+		res = append(res, supportedShells...)
+	case candidatesInstalled, candidatesTemplates, candidatesProfiles:
+		xx, err := NewEnvInteractor()
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case candidatesInstalled:
+			for _, v := range xx.manager.Installed() {
+				res = append(res, v.String())
+			}
+		case candidatesTemplates:
+			for _, t := range xx.templates.Templates() {
+				res = append(res, t.Installpath)
+			}
+		default:
+			for _, p := range xx.templates.Profiles() {
+				res = append(res, p.Name)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unknown candidates %s", kind)
+	}
+	return res, nil
+}
+
+type completionOption struct {
+	short       string
+	long        string
+	description string
+}
+
+// completionCommand is a visible command, or the root of the parser
+// if path is empty.
+type completionCommand struct {
+	path        string
+	name        string
+	description string
+	parent      string
+	options     []completionOption
+	subcommands []string
+}
+
+func completionOptions(groups []*flags.Group) []completionOption {
+	var res []completionOption
+	for _, g := range groups {
+		for _, o := range g.Options() {
+			if o.Hidden {
+				continue
+			}
+			co := completionOption{long: o.LongName, description: o.Description}
+			if o.ShortName != 0 {
+				co.short = string(o.ShortName)
+			}
+			res = append(res, co)
+		}
+		res = append(res, completionOptions(g.Groups())...)
+	}
+	return res
+}
+
+// completionCommands walks all visible commands of the parser
+func completionCommands(p *flags.Parser) []completionCommand {
+	var res []completionCommand
+	var walk func(parent string, c *flags.Command)
+	walk = func(parent string, c *flags.Command) {
+		cc := completionCommand{
+			path:        strings.TrimSpace(parent + " " + c.Name),
+			name:        c.Name,
+			description: c.ShortDescription,
+			parent:      parent,
+			options:     completionOptions([]*flags.Group{c.Group}),
+		}
+		if c == p.Command {
+			cc.path, cc.name = "", ""
+			cc.options = completionOptions(p.Groups())
+		}
+		var subs []*flags.Command
+		for _, s := range c.Commands() {
+			if s.Hidden == false {
+				subs = append(subs, s)
+			}
+		}
+		sort.Slice(subs, func(i, j int) bool { return subs[i].Name < subs[j].Name })
+		for _, s := range subs {
+			cc.subcommands = append(cc.subcommands, s.Name)
+		}
+		res = append(res, cc)
+		for _, s := range subs {
+			walk(cc.path, s)
+		}
+	}
+	walk("", p.Command)
+	return res
+}
+
+func (c completionCommand) optionWords() []string {
+	var res []string
+	for _, o := range c.options {
+		if len(o.short) != 0 {
+			res = append(res, "-"+o.short)
+		}
+		if len(o.long) != 0 {
+			res = append(res, "--"+o.long)
+		}
+	}
+	return res
+}
+
+// completionScript returns the completion script of shell for the
+// command name. Candidates are obtained by calling back self.
+func completionScript(shell, name, self string, commands []completionCommand) string {
+	if shell == "fish" {
+		return fishCompletionScript(name, self, commands)
+	}
+
+	fn := "_" + strings.Replace(name, "-", "_", -1)
+	var cmds, opts, kinds []string
+	for _, c := range commands {
+		cmds = append(cmds, fmt.Sprintf("    %s) echo %s ;;", shQuote(c.path), shQuote(strings.Join(c.subcommands, " "))))
+		opts = append(opts, fmt.Sprintf("    %s) echo %s ;;", shQuote(c.path), shQuote(strings.Join(c.optionWords(), " "))))
+		if k, ok := commandCandidates[c.path]; ok {
+			kinds = append(kinds, fmt.Sprintf("    %s) echo %s ;;", shQuote(c.path), k))
+		}
+	}
+
+	res := ""
+	if shell == "zsh" {
+		res = "autoload -U +X bashcompinit && bashcompinit\n"
+	}
+	return res + fmt.Sprintf(`%[1]s_commands() {
+  case "$1" in
+%[2]s
+  esac
+}
+%[1]s_options() {
+  case "$1" in
+%[3]s
+  esac
+}
+%[1]s_candidates() {
+  case "$1" in
+%[4]s
+  esac
+}
+%[1]s() {
+  local cur="${COMP_WORDS[COMP_CWORD]}" cmd="" i w words kind
+  for ((i = 1; i < COMP_CWORD; i++)); do
+    w="${COMP_WORDS[i]}"
+    case " $(%[1]s_commands "$cmd") " in
+      *" $w "*) cmd="${cmd:+$cmd }$w" ;;
+    esac
+  done
+  if [[ "$cur" == -* ]]; then
+    words="$(%[1]s_options "$cmd")"
+  else
+    words="$(%[1]s_commands "$cmd")"
+    kind="$(%[1]s_candidates "$cmd")"
+    if [ -n "$kind" ]; then
+      words="$words $(%[5]s complete-candidates "$kind" 2>/dev/null)"
+    fi
+  fi
+  COMPREPLY=($(compgen -W "$words" -- "$cur"))
+}
+complete -F %[1]s %[6]s
+`, fn, strings.Join(cmds, "\n"), strings.Join(opts, "\n"), strings.Join(kinds, "\n"), self, shQuote(name))
+}
+
+func fishCompletionScript(name, self string, commands []completionCommand) string {
+	var lines []string
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf("complete -c %s "+format, append([]interface{}{fishQuote(name)}, args...)...))
+	}
+	// the condition of completing the arguments of a command
+	condition := func(c completionCommand) string {
+		if len(c.path) == 0 {
+			return "__fish_use_subcommand"
+		}
+		res := "__fish_seen_subcommand_from " + c.name
+		if len(c.subcommands) != 0 {
+			res += "; and not __fish_seen_subcommand_from " + strings.Join(c.subcommands, " ")
+		}
+		return res
+	}
+
+	for _, c := range commands {
+		for _, s := range commands {
+			if s.parent == c.path && len(s.path) != 0 {
+				add("-f -n %s -a %s -d %s", fishQuote(condition(c)), fishQuote(s.name), fishQuote(s.description))
+			}
+		}
+		for _, o := range c.options {
+			flags := ""
+			if len(o.short) != 0 {
+				flags += " -s " + o.short
+			}
+			if len(o.long) != 0 {
+				flags += " -l " + o.long
+			}
+			if len(c.path) == 0 {
+				add("%s -d %s", flags[1:], fishQuote(o.description))
+			} else {
+				add("-n %s%s -d %s", fishQuote(condition(c)), flags, fishQuote(o.description))
+			}
+		}
+		if k, ok := commandCandidates[c.path]; ok {
+			add("-f -n %s -a %s", fishQuote(condition(c)), fishQuote(fmt.Sprintf("(%s complete-candidates %s 2>/dev/null)", self, k)))
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
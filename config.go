@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// Configuration files use the ini format of go-flags: global options
+// are in the [Application Options] section, and command options in a
+// section named after the command, e.g.
+//
+//	[Application Options]
+//	root = /opt
+//	archive = http://mirror.example.com/webots/
+//	archive = http://www.cyberbotics.com/archive/
+//
+//	[install]
+//	use = true
+//
+// The user configuration overlays the system one. Command line
+// options and environment variables take precedence over both.
+
+const (
+	systemConfigPath    = "/etc/webots-manager.conf"
+	globalConfigSection = "Application Options"
+	configUserFileName  = "webots-manager.conf"
+)
+
+func userConfigPath() (string, error) {
+	if configHome := os.Getenv("XDG_CONFIG_HOME"); path.IsAbs(configHome) {
+		return path.Join(configHome, configUserFileName), nil
+	}
+	home := os.Getenv("HOME")
+	if path.IsAbs(home) == false {
+		return "", fmt.Errorf("Cannot find user configuration directory, neither XDG_CONFIG_HOME nor HOME are set")
+	}
+	return path.Join(home, ".config", configUserFileName), nil
+}
+
+// configFiles returns existing configuration files, by increasing
+// priority.
+func configFiles() []string {
+	candidates := []string{systemConfigPath}
+	if p, err := userConfigPath(); err == nil {
+		candidates = append(candidates, p)
+	}
+	var res []string
+	for _, p := range candidates {
+		if _, err := os.Stat(p); err == nil {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+type configOption struct {
+	key     string
+	section string
+	option  *flags.Option
+}
+
+// configOptions lists all options that can be set in a configuration
+// file, with their key name for the config command.
+func configOptions() []configOption {
+	var res []configOption
+	add := func(prefix, section string, g *flags.Group) {
+		for _, o := range g.Options() {
+			if len(o.LongName) == 0 || o.LongName == "help" {
+				continue
+			}
+			res = append(res, configOption{
+				key:     prefix + o.LongName,
+				section: section,
+				option:  o,
+			})
+		}
+	}
+	for _, g := range parser.Groups() {
+		add("", globalConfigSection, g)
+	}
+	for _, c := range parser.Commands() {
+		add(c.Name+".", c.Name, c.Group)
+		for _, g := range c.Groups() {
+			add(c.Name+".", c.Name, g)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].key < res[j].key })
+	return res
+}
+
+func findConfigOption(key string) (configOption, error) {
+	for _, o := range configOptions() {
+		if o.key == key {
+			return o, nil
+		}
+	}
+	return configOption{}, fmt.Errorf("Unknown configuration key %s", key)
+}
+
+// configSources tells, by key, where loadConfig read values from.
+// configLoaded keeps the loaded values, to detect the ones modified by
+// the command line.
+var (
+	configSources = make(map[string]string)
+	configLoaded  = make(map[string]string)
+)
+
+// loadConfig reads configuration files, then the environment. It
+// should be called before parsing the command line, which
+// overrides these values.
+func loadConfig() error {
+	// each file replaces values of the previous ones, lists included
+	ini := flags.NewIniParser(parser)
+	for _, p := range configFiles() {
+		if err := ini.ParseFile(p); err != nil {
+			return fmt.Errorf("Could not read configuration %s: %s", p, err)
+		}
+		keys, err := configFileKeys(p)
+		if err != nil {
+			return fmt.Errorf("Could not read configuration %s: %s", p, err)
+		}
+		source := "user " + p
+		if p == systemConfigPath {
+			source = "system " + p
+		}
+		for _, k := range keys {
+			configSources[k] = source
+		}
+	}
+
+	// go-flags only use environment as a default value, which would
+	// be ignored if set in a file.
+	for _, o := range configOptions() {
+		envKey := o.option.EnvKeyWithNamespace()
+		if len(envKey) == 0 {
+			continue
+		}
+		if value, ok := os.LookupEnv(envKey); ok {
+			if err := o.option.Set(&value); err != nil {
+				return fmt.Errorf("Invalid %s=%s: %s", envKey, value, err)
+			}
+			configSources[o.key] = "environment " + envKey
+		}
+	}
+
+	for _, o := range configOptions() {
+		configLoaded[o.key] = strings.Join(formatConfigValue(o.option.Value()), "\n")
+	}
+	return nil
+}
+
+// configFileKeys returns the keys set in the configuration file p
+func configFileKeys(p string) ([]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []string
+	section := globalConfigSection
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		switch {
+		case len(l) == 0 || l[0] == ';' || l[0] == '#':
+		case strings.HasPrefix(l, "[") && strings.HasSuffix(l, "]"):
+			section = strings.TrimSpace(l[1 : len(l)-1])
+		default:
+			name := strings.TrimSpace(strings.SplitN(l, "=", 2)[0])
+			if strings.EqualFold(section, globalConfigSection) {
+				res = append(res, name)
+			} else {
+				res = append(res, section+"."+name)
+			}
+		}
+	}
+	return res, scanner.Err()
+}
+
+// configSource returns where the current value of o comes from
+func configSource(o configOption) string {
+	if o.option.IsSetDefault() {
+		return "default"
+	}
+	if strings.Join(formatConfigValue(o.option.Value()), "\n") != configLoaded[o.key] {
+		return "command line"
+	}
+	if source, ok := configSources[o.key]; ok {
+		return source
+	}
+	return "default"
+}
+
+// formatConfigValue returns the ini representation of an option
+// value, one element per line for lists.
+func formatConfigValue(v interface{}) []string {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Slice {
+		res := make([]string, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			res = append(res, fmt.Sprintf("%v", rv.Index(i).Interface()))
+		}
+		return res
+	}
+	return []string{fmt.Sprintf("%v", v)}
+}
+
+// setConfigValue replaces all the values of key in the ini file at
+// p, keeping any other content. An empty values removes the key.
+func setConfigValue(p string, o configOption, values []string) error {
+	content, err := ioutil.ReadFile(p)
+	if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+
+	var lines []string
+	if len(content) != 0 {
+		lines = strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	}
+
+	name := o.option.LongName
+	header := "[" + o.section + "]"
+	var res []string
+	inSection, found := false, false
+	insert := func() {
+		for _, v := range values {
+			res = append(res, fmt.Sprintf("%s = %s", name, v))
+		}
+		found = true
+	}
+	for _, l := range lines {
+		trimmed := strings.TrimSpace(l)
+		if strings.HasPrefix(trimmed, "[") {
+			if inSection && found == false {
+				insert()
+			}
+			inSection = strings.EqualFold(trimmed, header)
+			res = append(res, l)
+			continue
+		}
+		if inSection {
+			if kv := strings.SplitN(trimmed, "=", 2); len(kv) == 2 && strings.TrimSpace(kv[0]) == name {
+				if found == false {
+					insert()
+				}
+				continue
+			}
+		}
+		res = append(res, l)
+	}
+	if inSection && found == false {
+		insert()
+	}
+	if found == false && len(values) != 0 {
+		if len(res) != 0 {
+			res = append(res, "")
+		}
+		res = append(res, header)
+		insert()
+	}
+
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, l := range res {
+		fmt.Fprintln(w, l)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+// VersionUsage describes the disk usage of a single installed
+// version. Unique bytes are only referenced by this version, Shared
+// bytes are hardlinked with at least one other version.
+type VersionUsage struct {
+	Version          WebotsVersion
+	Apparent         int64
+	Unique, Shared   int64
+	Files, Hardlinks int
+}
+
+type DiskUsageReport struct {
+	Versions []VersionUsage
+	// Total is the real size of the store, each inode counted once
+	Total int64
+	// Apparent is the size the store would have without any hardlink
+	Apparent int64
+	// Shared is the size of inodes referenced by several versions
+	Shared int64
+}
+
+type DedupStats struct {
+	Linked int
+	Saved  int64
+}
+
+type inodeKey struct {
+	Dev, Ino uint64
+}
+
+type storeFile struct {
+	version WebotsVersion
+	path    string
+	size    int64
+	mode    os.FileMode
+	uid     uint32
+	gid     uint32
+	inode   inodeKey
+	nlink   uint64
+}
+
+// walkVersionFiles lists all regular files of an installed
+// version. Symlinks (including templates), directories and the paths
+// in skipped, relative to root, are ignored.
+func walkVersionFiles(root string, v WebotsVersion, skipped map[string]bool) ([]storeFile, error) {
+	var res []storeFile
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if skipped[rel] && fi.IsDir() {
+			return filepath.SkipDir
+		}
+		if skipped[rel] || fi.Mode().IsRegular() == false {
+			return nil
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if ok == false {
+			return fmt.Errorf("Cannot read inode information of %s", p)
+		}
+		res = append(res, storeFile{
+			version: v,
+			path:    p,
+			size:    fi.Size(),
+			mode:    fi.Mode(),
+			uid:     st.Uid,
+			gid:     st.Gid,
+			inode:   inodeKey{Dev: uint64(st.Dev), Ino: uint64(st.Ino)},
+			nlink:   uint64(st.Nlink),
+		})
+		return nil
+	})
+	return res, err
+}
+
+// walkStore lists the files of versions vers, except the ones
+// templates may install or replace: they are rewritten in place, and
+// must never be shared.
+func (m *SymlinkWebotsManager) walkStore(vers []WebotsVersion) ([]storeFile, error) {
+	tracked, err := m.templates.TrackedFiles()
+	if err != nil {
+		return nil, err
+	}
+	var res []storeFile
+	for _, v := range vers {
+		files, err := walkVersionFiles(path.Join(m.workpath, v.String()), v, tracked)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, files...)
+	}
+	return res, nil
+}
+
+func (m *SymlinkWebotsManager) DiskUsage() (*DiskUsageReport, error) {
+	if err := m.tryRLock(); err != nil {
+		return nil, err
+	}
+	defer m.unlock()
+
+	files, err := m.walkStore(m.installed)
+	if err != nil {
+		return nil, err
+	}
+
+	// for each inode, the set of versions referencing it
+	owners := make(map[inodeKey]map[WebotsVersion]bool)
+	sizes := make(map[inodeKey]int64)
+	for _, f := range files {
+		if _, ok := owners[f.inode]; ok == false {
+			owners[f.inode] = make(map[WebotsVersion]bool)
+		}
+		owners[f.inode][f.version] = true
+		sizes[f.inode] = f.size
+	}
+
+	res := &DiskUsageReport{}
+	byVersion := make(map[WebotsVersion]*VersionUsage)
+	for _, v := range m.installed {
+		res.Versions = append(res.Versions, VersionUsage{Version: v})
+	}
+	for i := range res.Versions {
+		byVersion[res.Versions[i].Version] = &res.Versions[i]
+	}
+
+	seen := make(map[WebotsVersion]map[inodeKey]bool)
+	for _, f := range files {
+		u := byVersion[f.version]
+		u.Apparent += f.size
+		u.Files++
+		res.Apparent += f.size
+		if seen[f.version] == nil {
+			seen[f.version] = make(map[inodeKey]bool)
+		}
+		if seen[f.version][f.inode] == true {
+			u.Hardlinks++
+			continue
+		}
+		seen[f.version][f.inode] = true
+		if len(owners[f.inode]) > 1 {
+			u.Shared += f.size
+		} else {
+			u.Unique += f.size
+		}
+	}
+
+	for ino, size := range sizes {
+		res.Total += size
+		if len(owners[ino]) > 1 {
+			res.Shared += size
+		}
+	}
+
+	return res, nil
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// replaceByLink atomically replaces dest by a hardlink to src.
+func replaceByLink(src, dest string) error {
+	tmp := fmt.Sprintf("%s.dedup-%d", dest, os.Getpid())
+	if err := os.Link(src, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Dedup hardlinks identical files across installed versions. If only
+// is not empty, only files belonging to these versions are replaced,
+// but they can be linked to files of any installed version.
+func (m *SymlinkWebotsManager) Dedup(only []WebotsVersion, dryRun bool) (DedupStats, error) {
+	lock := m.tryLock
+	if dryRun {
+		lock = m.tryRLock
+	}
+	if err := lock(); err != nil {
+		return DedupStats{}, err
+	}
+	defer m.unlock()
+	return m.dedup(only, dryRun)
+}
+
+func (m *SymlinkWebotsManager) dedup(only []WebotsVersion, dryRun bool) (DedupStats, error) {
+	stats := DedupStats{}
+	files, err := m.walkStore(m.installed)
+	if err != nil {
+		return stats, err
+	}
+
+	target := make(map[WebotsVersion]bool)
+	for _, v := range only {
+		target[v] = true
+	}
+	isTarget := func(f storeFile) bool {
+		return len(target) == 0 || target[f.version]
+	}
+
+	// files can only be shared if they have the same metadata, as it
+	// is stored in the inode. The modification time is not part of it:
+	// each release is built anew, so identical files of two versions
+	// seldom have the same one. Linked files get the one of the kept
+	// inode.
+	type candidateKey struct {
+		size     int64
+		mode     os.FileMode
+		uid, gid uint32
+		dev      uint64
+	}
+	candidates := make(map[candidateKey][]storeFile)
+	for _, f := range files {
+		if f.size == 0 {
+			continue
+		}
+		k := candidateKey{size: f.size, mode: f.mode, uid: f.uid, gid: f.gid, dev: f.inode.Dev}
+		candidates[k] = append(candidates[k], f)
+	}
+
+	for _, group := range candidates {
+		inodes := make(map[inodeKey]bool)
+		hasTarget := false
+		for _, f := range group {
+			inodes[f.inode] = true
+			hasTarget = hasTarget || isTarget(f)
+		}
+		if len(inodes) < 2 || hasTarget == false {
+			continue
+		}
+
+		hashes := make(map[inodeKey]string)
+		byHash := make(map[string][]storeFile)
+		for _, f := range group {
+			h, ok := hashes[f.inode]
+			if ok == false {
+				h, err = hashFile(f.path)
+				if err != nil {
+					return stats, err
+				}
+				hashes[f.inode] = h
+			}
+			byHash[h] = append(byHash[h], f)
+		}
+
+		for _, same := range byHash {
+			// keep the most linked inode, to minimize the number of
+			// replacement
+			canonical := same[0]
+			for _, f := range same[1:] {
+				if f.nlink > canonical.nlink {
+					canonical = f
+				}
+			}
+			// number of paths to an inode we replaced
+			removed := make(map[inodeKey]uint64)
+			for _, f := range same {
+				if f.inode == canonical.inode || isTarget(f) == false {
+					continue
+				}
+				if dryRun == false {
+					if err := replaceByLink(canonical.path, f.path); err != nil {
+						return stats, fmt.Errorf("Cannot link %s to %s: %s", f.path, canonical.path, err)
+					}
+				}
+				stats.Linked++
+				removed[f.inode]++
+				if removed[f.inode] == f.nlink {
+					stats.Saved += f.size
+				}
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// writeUnshared writes the content of r to dest without ever
+// modifying an existing inode in place : as versions may share
+// hardlinked files, truncating dest could modify other versions.
+func writeUnshared(dest string, r io.Reader, mode os.FileMode) error {
+	f, err := ioutil.TempFile(path.Dir(dest), "."+path.Base(dest)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+var sizeUnits = []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+func humanSize(s int64) string {
+	v := float64(s)
+	i := 0
+	for v >= 1024 && i < len(sizeUnits)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d %s", s, sizeUnits[0])
+	}
+	return fmt.Sprintf("%.1f %s", v, sizeUnits[i])
+}
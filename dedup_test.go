@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDedupSkipsTemplates(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	files := map[string]string{
+		"webots":                "webots",
+		"conf/shipped.ini":      "shipped",
+		"conf/replaced.ini":     "replaced",
+		"projects/default.wbt":  "world",
+		"projects/other/a.wbt":  "world a",
+		"resources/lib/libc.so": "library",
+	}
+	for _, v := range []string{"8.5.4", "8.6.0"} {
+		writeTestTree(t, path.Join(m.workpath, v), files)
+	}
+
+	// templates may replace these files later, even if they are not
+	// installed yet
+	writeTestTree(t, m.basepath, map[string]string{"template": "template"})
+	for _, installpath := range []string{"conf/replaced.ini", "/projects/"} {
+		if err := m.templates.RegisterTemplate(path.Join(m.basepath, "template"), installpath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.listInstalled(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := m.Dedup(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked := map[string]bool{
+		"conf/replaced.ini":    true,
+		"projects/default.wbt": true,
+		"projects/other/a.wbt": true,
+	}
+	if stats.Linked != 3 {
+		t.Errorf("Expected 3 linked files, got %d", stats.Linked)
+	}
+	for rel := range files {
+		a, err := os.Stat(path.Join(m.workpath, "8.5.4", rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.Stat(path.Join(m.workpath, "8.6.0", rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(a, b) == tracked[rel] {
+			t.Errorf("Unexpected sharing of %s: %v", rel, os.SameFile(a, b))
+		}
+	}
+}
+
+func TestDedupSkipsInstalledTemplates(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	for _, v := range []string{"8.5.4", "8.6.0"} {
+		writeTestTree(t, path.Join(m.workpath, v), map[string]string{
+			"webots":              "webots",
+			"conf/shipped.ini":    "shipped",
+			"conf/overridden.ini": "overridden",
+		})
+	}
+
+	render := func(installpath string) error {
+		return m.templates.Render(installpath, nil)
+	}
+	overrideCopy := func(installpath string) error {
+		if err := m.templates.Override(installpath); err != nil {
+			return err
+		}
+		return m.templates.Copy(installpath)
+	}
+	testdata := []struct {
+		installpath string
+		register    func(installpath string) error
+	}{
+		{"conf/copied.ini", m.templates.Copy},
+		{"conf/rendered.ini", render},
+		{"conf/overridden.ini", overrideCopy},
+	}
+	for _, d := range testdata {
+		writeTestTree(t, m.basepath, map[string]string{"template": "template " + d.installpath})
+		if err := m.templates.RegisterTemplate(path.Join(m.basepath, "template"), d.installpath); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.register(d.installpath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.listInstalled(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ApplyAllTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := m.Dedup(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only webots and conf/shipped.ini are not tracked by templates
+	if stats.Linked != 2 {
+		t.Errorf("Expected 2 linked files, got %d", stats.Linked)
+	}
+	for _, d := range testdata {
+		a, err := os.Lstat(path.Join(m.workpath, "8.5.4", d.installpath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.Lstat(path.Join(m.workpath, "8.6.0", d.installpath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(a, b) {
+			t.Errorf("Template %s was hardlinked across versions", d.installpath)
+		}
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The doctor checks the whole setup without opening the store through
+// NewSymlinkManager, as the problems it diagnoses are the ones that
+// make it fail.
+
+// DoctorProblem is a problem found by the doctor, with a suggested
+// fix. If it can be fixed automatically, fix is not nil.
+type DoctorProblem struct {
+	Description string
+	Suggestion  string
+	fix         func() error
+}
+
+func (p DoctorProblem) Fixable() bool {
+	return p.fix != nil
+}
+
+func (p DoctorProblem) Fix() error {
+	if p.fix == nil {
+		return fmt.Errorf("Cannot be fixed automatically")
+	}
+	return p.fix()
+}
+
+type DoctorCheck struct {
+	Name     string
+	Problems []DoctorProblem
+}
+
+type doctor struct {
+	workpath    string
+	installpath string
+	usedpath    string
+	gid         int
+	installed   []WebotsVersion
+}
+
+// workpathEntries are the files of the workpath that are not versions
+var workpathEntries = map[string]bool{
+	"used":                true,
+	"templates":           true,
+	shimSubdir:            true,
+	"global.lock":         true,
+	"global.lock.holders": true,
+	"history.json":        true,
+	"modulefiles.json":    true,
+}
+
+// LockStore takes the exclusive lock of the store, so that fixing
+// problems does not race with other commands. A missing store is not
+// locked.
+func LockStore() (func(), error) {
+	_, workpath, _, err := symlinkManagerPath()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(workpath); os.IsNotExist(err) {
+		return func() {}, nil
+	}
+	l, err := NewFileLock(path.Join(workpath, "global.lock"))
+	if err != nil {
+		return nil, err
+	}
+	if err := l.Lock(); err != nil {
+		return nil, err
+	}
+	return func() { l.Unlock() }, nil
+}
+
+// Diagnose runs all checks of the setup
+func Diagnose() ([]DoctorCheck, error) {
+	d := &doctor{gid: -1}
+	var err error
+	_, d.workpath, d.installpath, err = symlinkManagerPath()
+	if err != nil {
+		return nil, err
+	}
+	d.usedpath = path.Join(d.workpath, "used")
+
+	checks := []struct {
+		name string
+		run  func() []DoctorProblem
+	}{
+		{"group", d.checkGroup},
+		{"workpath", d.checkWorkpath},
+		{"symlinks", d.checkSymlinks},
+		{"WEBOTS_HOME", d.checkWebotsHome},
+		{"locks", d.checkLocks},
+		{"versions", d.checkVersions},
+		{"templates", d.checkTemplates},
+		{"archives", d.checkArchives},
+	}
+	var res []DoctorCheck
+	for _, c := range checks {
+		res = append(res, DoctorCheck{Name: c.name, Problems: c.run()})
+	}
+	return res, nil
+}
+
+func manualFix(description, suggestion string) DoctorProblem {
+	return DoctorProblem{Description: description, Suggestion: suggestion}
+}
+
+func initSuggestion() string {
+	if options.User {
+		return "run webots-manager --user init"
+	}
+	return "run sudo webots-manager init"
+}
+
+func (d *doctor) checkGroup() []DoctorProblem {
+	if options.User {
+		d.gid = os.Getgid()
+		return nil
+	}
+	gid, err := getGid("webots-manager")
+	if err != nil {
+		return []DoctorProblem{manualFix(fmt.Sprintf("Could not read system groups: %s", err), "check /etc/group")}
+	}
+	if gid == -1 {
+		return []DoctorProblem{manualFix("Group webots-manager does not exist", initSuggestion())}
+	}
+	d.gid = gid
+
+	groups, err := os.Getgroups()
+	if err != nil {
+		return []DoctorProblem{manualFix(fmt.Sprintf("Could not read groups of current user: %s", err), "")}
+	}
+	for _, g := range groups {
+		if g == gid {
+			return nil
+		}
+	}
+	return []DoctorProblem{manualFix("Current user is not in webots-manager group",
+		fmt.Sprintf("run sudo usermod -a -G webots-manager %s and log in again, or use --user for a per-user store", currentUserName()))}
+}
+
+// checkDirectory checks the group and setgid bit of a directory of
+// the store.
+func (d *doctor) checkDirectory(p string) []DoctorProblem {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return []DoctorProblem{manualFix(fmt.Sprintf("Could not read %s: %s", p, err), initSuggestion())}
+	}
+	if options.User || d.gid == -1 {
+		return nil
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if ok == false {
+		return nil
+	}
+	var res []DoctorProblem
+	if int(st.Gid) != d.gid {
+		res = append(res, DoctorProblem{
+			Description: fmt.Sprintf("%s is not owned by group webots-manager", p),
+			Suggestion:  fmt.Sprintf("run sudo chgrp -R webots-manager %s", p),
+			fix: func() error {
+				return chownGroupTree(p, d.gid)
+			},
+		})
+	}
+	if fi.Mode()&os.ModeSetgid == 0 || fi.Mode()&0070 != 0070 {
+		res = append(res, DoctorProblem{
+			Description: fmt.Sprintf("%s is not group writable with setgid bit (mode %s)", p, fi.Mode()),
+			Suggestion:  fmt.Sprintf("run sudo chmod g+rwxs %s", p),
+			fix: func() error {
+				return os.Chmod(p, fi.Mode().Perm()|0070|os.ModeSetgid)
+			},
+		})
+	}
+	return res
+}
+
+func chownGroupTree(root string, gid int) error {
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, -1, gid)
+	})
+}
+
+func (d *doctor) checkWorkpath() []DoctorProblem {
+	fi, err := os.Stat(d.workpath)
+	if os.IsNotExist(err) {
+		return []DoctorProblem{manualFix(fmt.Sprintf("Store %s does not exist", d.workpath), initSuggestion())}
+	}
+	if err == nil && fi.IsDir() == false {
+		return []DoctorProblem{manualFix(fmt.Sprintf("Store %s is not a directory", d.workpath), fmt.Sprintf("remove it and %s", initSuggestion()))}
+	}
+
+	res := d.checkDirectory(d.workpath)
+	files, err := ioutil.ReadDir(d.workpath)
+	if err != nil {
+		return append(res, manualFix(fmt.Sprintf("Could not list %s: %s", d.workpath, err), ""))
+	}
+	for _, fi := range files {
+		if fi.IsDir() == false {
+			continue
+		}
+		if v, err := ParseWebotsVersion(fi.Name()); err == nil {
+			d.installed = append(d.installed, v)
+		}
+		if fi.Name() == "templates" || fi.Name() == shimSubdir || strings.HasSuffix(fi.Name(), ".holders") {
+			continue
+		}
+		res = append(res, d.checkDirectory(path.Join(d.workpath, fi.Name()))...)
+	}
+	return res
+}
+
+// checkSymlinks checks the chain installpath -> used -> version
+func (d *doctor) checkSymlinks() []DoctorProblem {
+	var res []DoctorProblem
+	if options.User == false {
+		fi, err := os.Lstat(d.installpath)
+		switch {
+		case os.IsNotExist(err):
+			res = append(res, DoctorProblem{
+				Description: fmt.Sprintf("%s does not exist", d.installpath),
+				Suggestion:  initSuggestion(),
+				fix: func() error {
+					return os.Symlink(d.usedpath, d.installpath)
+				},
+			})
+		case err != nil:
+			res = append(res, manualFix(fmt.Sprintf("Could not read %s: %s", d.installpath, err), ""))
+		case fi.Mode()&os.ModeSymlink == 0:
+			res = append(res, manualFix(fmt.Sprintf("%s is not a symlink, webots seems installed manually", d.installpath),
+				"run sudo webots-manager init --adopt, or remove it"))
+		default:
+			if dest, err := os.Readlink(d.installpath); err == nil && dest != d.usedpath {
+				res = append(res, DoctorProblem{
+					Description: fmt.Sprintf("%s points to %s instead of %s", d.installpath, dest, d.usedpath),
+					Suggestion:  fmt.Sprintf("run sudo ln -sfn %s %s", d.usedpath, d.installpath),
+					fix: func() error {
+						if err := os.Remove(d.installpath); err != nil {
+							return err
+						}
+						return os.Symlink(d.usedpath, d.installpath)
+					},
+				})
+			}
+		}
+	}
+
+	fi, err := os.Lstat(d.usedpath)
+	if os.IsNotExist(err) {
+		return append(res, manualFix("No version is used", "run webots-manager use VERSION"))
+	}
+	if err != nil {
+		return append(res, manualFix(fmt.Sprintf("Could not read %s: %s", d.usedpath, err), ""))
+	}
+	removeUsed := func() error {
+		return os.RemoveAll(d.usedpath)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return append(res, DoctorProblem{
+			Description: fmt.Sprintf("%s exists but it is not a symlink", d.usedpath),
+			Suggestion:  fmt.Sprintf("remove %s, then run webots-manager use VERSION", d.usedpath),
+			fix:         removeUsed,
+		})
+	}
+	dest, err := os.Readlink(d.usedpath)
+	if err != nil {
+		return append(res, manualFix(fmt.Sprintf("Could not read %s: %s", d.usedpath, err), ""))
+	}
+	v, err := ParseWebotsVersion(dest)
+	if err != nil {
+		return append(res, DoctorProblem{
+			Description: fmt.Sprintf("%s points to %s, which is not a version", d.usedpath, dest),
+			Suggestion:  fmt.Sprintf("remove %s, then run webots-manager use VERSION", d.usedpath),
+			fix:         removeUsed,
+		})
+	}
+	for _, vv := range d.installed {
+		if vv == v {
+			return res
+		}
+	}
+	return append(res, DoctorProblem{
+		Description: fmt.Sprintf("Used version %s is not installed", v),
+		Suggestion:  fmt.Sprintf("run webots-manager install %s, or remove %s and use another version", v, d.usedpath),
+		fix:         removeUsed,
+	})
+}
+
+func (d *doctor) checkWebotsHome() []DoctorProblem {
+	webotsHome := os.Getenv("WEBOTS_HOME")
+	if len(webotsHome) == 0 {
+		return []DoctorProblem{manualFix("WEBOTS_HOME is not set", fmt.Sprintf("export WEBOTS_HOME=%s in your shell profile", d.installpath))}
+	}
+	if path.Clean(webotsHome) == d.installpath {
+		return nil
+	}
+	for _, v := range d.installed {
+		if path.Clean(webotsHome) == path.Join(d.workpath, v.String()) {
+			return nil
+		}
+	}
+	return []DoctorProblem{manualFix(fmt.Sprintf("WEBOTS_HOME=%s is not a managed version", webotsHome),
+		fmt.Sprintf("export WEBOTS_HOME=%s in your shell profile", d.installpath))}
+}
+
+func (d *doctor) checkLocks() []DoctorProblem {
+	var res []DoctorProblem
+	for _, p := range []string{path.Join(d.workpath, "global.lock"), path.Join(d.workpath, "templates", "global.lock")} {
+		l, err := NewFileLock(p)
+		if err != nil {
+			res = append(res, manualFix(err.Error(), ""))
+			continue
+		}
+		_, stale, err := l.readHolders()
+		if err != nil {
+			res = append(res, manualFix(fmt.Sprintf("Could not read holders of %s: %s", p, err), ""))
+			continue
+		}
+		for _, h := range stale {
+			holder := path.Join(l.holdersPath(), strconv.Itoa(h.Pid))
+			res = append(res, DoctorProblem{
+				Description: fmt.Sprintf("Stale lock information of crashed process %s", h),
+				Suggestion:  fmt.Sprintf("remove %s", holder),
+				fix: func() error {
+					return os.Remove(holder)
+				},
+			})
+		}
+	}
+	return res
+}
+
+// checkVersions looks for unknown entries in the workpath, abandoned
+// extractions and incomplete versions. Only abandoned extractions are
+// removed automatically, as nothing else writes in them.
+func (d *doctor) checkVersions() []DoctorProblem {
+	files, err := ioutil.ReadDir(d.workpath)
+	if err != nil {
+		return nil
+	}
+	var res []DoctorProblem
+	for _, fi := range files {
+		p := path.Join(d.workpath, fi.Name())
+		if fi.IsDir() && strings.HasPrefix(fi.Name(), extractionPrefix) {
+			res = append(res, DoctorProblem{
+				Description: fmt.Sprintf("%s is an interrupted extraction", p),
+				Suggestion:  fmt.Sprintf("remove %s", p),
+				fix: func() error {
+					return os.RemoveAll(p)
+				},
+			})
+			continue
+		}
+		v, err := ParseWebotsVersion(fi.Name())
+		if err != nil || fi.IsDir() == false {
+			if workpathEntries[fi.Name()] {
+				continue
+			}
+			res = append(res, manualFix(fmt.Sprintf("%s is not a version nor a file of webots-manager", p),
+				fmt.Sprintf("remove %s if you do not need it", p)))
+			continue
+		}
+		if _, err := os.Stat(path.Join(p, "webots")); err == nil {
+			continue
+		}
+		res = append(res, manualFix(fmt.Sprintf("Version %s is incomplete, webots is missing", v),
+			fmt.Sprintf("run webots-manager install %s", v)))
+	}
+	return res
+}
+
+func (d *doctor) checkTemplates() []DoctorProblem {
+	basepath := path.Join(d.workpath, "templates")
+	if _, err := os.Stat(basepath); err != nil {
+		return nil
+	}
+	templates, err := NewHasHTemplateManager(basepath)
+	if err != nil {
+		return []DoctorProblem{manualFix(fmt.Sprintf("Could not read templates: %s", err), "")}
+	}
+
+	var res []DoctorProblem
+	for _, v := range d.installed {
+		v := v
+		root := path.Join(d.workpath, v.String())
+		apply := func() error {
+			return templates.ApplyTemplates(root, v)
+		}
+
+		// links to templates that do not exist anymore
+		filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+				return nil
+			}
+			dest, err := os.Readlink(p)
+			if err != nil || strings.HasPrefix(dest, basepath+"/") == false {
+				return nil
+			}
+			if _, err := os.Stat(dest); os.IsNotExist(err) {
+				res = append(res, DoctorProblem{
+					Description: fmt.Sprintf("%s is a dangling link to removed template data %s", p, dest),
+					Suggestion:  fmt.Sprintf("remove %s", p),
+					fix: func() error {
+						return os.Remove(p)
+					},
+				})
+			}
+			return nil
+		})
+
+		for _, t := range templates.Templates() {
+			files, err := templates.TemplateFiles(t.Installpath)
+			if err != nil {
+				continue
+			}
+			for _, rel := range files {
+				res = append(res, checkTemplateFile(root, basepath, v, t, rel, apply)...)
+			}
+		}
+	}
+
+	for _, t := range templates.Templates() {
+		if _, err := os.Stat(path.Join(basepath, t.Datapath)); err != nil {
+			res = append(res, manualFix(fmt.Sprintf("Data of template %s is missing", t.Installpath),
+				fmt.Sprintf("run webots-manager remove-template %s, then add it again", t.Installpath)))
+		}
+	}
+	return res
+}
+
+// checkTemplateFile checks the file rel of template t in version v
+func checkTemplateFile(root, basepath string, v WebotsVersion, t Template, rel string, apply func() error) []DoctorProblem {
+	target := path.Join(root, t.target(rel))
+	data := path.Join(basepath, t.Datapath, rel)
+	if t.Patched && t.Patches[v.String()] == PatchFailed {
+		return []DoctorProblem{manualFix(fmt.Sprintf("Patch %s does not apply to %s", t.Installpath, v),
+			fmt.Sprintf("fix the patch, then run webots-manager update-template PATCH %s", t.Installpath))}
+	}
+	if t.copied() {
+		return checkTemplateCopy(target, copyKey(v, rel), v, t, apply)
+	}
+	var res []DoctorProblem
+	dest, err := os.Readlink(target)
+	installed := err == nil && dest == data
+	switch {
+	case t.AppliesTo(v) && installed == false && err == nil:
+		res = append(res, manualFix(fmt.Sprintf("%s is not template %s (points to %s)", target, t.Installpath, dest),
+			fmt.Sprintf("remove %s, then run webots-manager doctor --fix", target)))
+	case t.AppliesTo(v) && installed == false:
+		if _, lerr := os.Lstat(target); lerr == nil {
+			res = append(res, manualFix(fmt.Sprintf("%s exists and is not template %s", target, t.Installpath),
+				fmt.Sprintf("remove %s, then run webots-manager doctor --fix", target)))
+			break
+		}
+		res = append(res, DoctorProblem{
+			Description: fmt.Sprintf("Template %s is missing in %s", t.target(rel), v),
+			Suggestion:  "run webots-manager doctor --fix to apply templates again",
+			fix:         apply,
+		})
+	case t.AppliesTo(v) == false && installed:
+		res = append(res, DoctorProblem{
+			Description: fmt.Sprintf("Template %s should not be installed in %s", t.target(rel), v),
+			Suggestion:  "run webots-manager doctor --fix to apply templates again",
+			fix:         apply,
+		})
+	}
+	return res
+}
+
+func (d *doctor) checkArchives() []DoctorProblem {
+	var res []DoctorProblem
+	for _, u := range options.Archives {
+		a, err := NewWebotsHttpArchive(u)
+		if err != nil {
+			res = append(res, manualFix(fmt.Sprintf("Archive %s is not reachable: %s", u, err),
+				"check your network, or the --archive, --http-proxy and --arch options"))
+			continue
+		}
+		if len(a.AvailableVersions()) == 0 {
+			res = append(res, manualFix(fmt.Sprintf("Archive %s provides no version", u),
+				"check the --archive and --arch options"))
+		}
+	}
+	return res
+}
+
+func checkTemplateCopy(target, key string, v WebotsVersion, t Template, apply func() error) []DoctorProblem {
+	_, recorded := t.Copies[key]
+	_, ours, err := installedCopy(target, t.Copies[key])
+	switch {
+	case err != nil && os.IsNotExist(err) == false:
+		return []DoctorProblem{manualFix(fmt.Sprintf("Could not read %s: %s", target, err), "")}
+	case t.AppliesTo(v) && err != nil:
+		return []DoctorProblem{{
+			Description: fmt.Sprintf("Template %s is missing in %s", target, v),
+			Suggestion:  "run webots-manager doctor --fix to apply templates again",
+			fix:         apply,
+		}}
+	case ours == false && recorded:
+		return []DoctorProblem{manualFix(fmt.Sprintf("%s was modified since installed by template %s", target, t.Installpath),
+			fmt.Sprintf("remove %s, then run webots-manager doctor --fix", target))}
+	case t.AppliesTo(v) && ours == false:
+		return []DoctorProblem{manualFix(fmt.Sprintf("%s exists and is not template %s", target, t.Installpath),
+			fmt.Sprintf("remove %s, then run webots-manager doctor --fix", target))}
+	case t.AppliesTo(v) == false && ours:
+		return []DoctorProblem{{
+			Description: fmt.Sprintf("Template %s should not be installed in %s", target, v),
+			Suggestion:  "run webots-manager doctor --fix to apply templates again",
+			fix:         apply,
+		}}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// EnvVar is an environment variable set up for a webots version. If
+// List is true, Value is a colon separated list of paths.
+type EnvVar struct {
+	Name  string
+	Value string
+	List  bool
+}
+
+// webotsLibPath returns where the libraries of the webots installed in
+// home are.
+func webotsLibPath(home string) string {
+	return path.Join(home, "lib")
+}
+
+// webotsEnv returns the environment needed to use the webots
+// installed in home. Paths of other managed versions are removed from
+// the current PATH and LD_LIBRARY_PATH, so the environment can be
+// switched several times in the same shell. Paths in kept, under a
+// managed one, are not versions and stay.
+func webotsEnv(home string, managed, kept []string) []EnvVar {
+	isManaged := func(p string) bool {
+		for _, k := range kept {
+			if p == k {
+				return false
+			}
+		}
+		for _, m := range managed {
+			if p == m || strings.HasPrefix(p, m+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	prepend := func(first, current string) string {
+		res := []string{first}
+		for _, p := range strings.Split(current, ":") {
+			if len(p) == 0 || isManaged(path.Clean(p)) {
+				continue
+			}
+			res = append(res, p)
+		}
+		return strings.Join(res, ":")
+	}
+
+	return []EnvVar{
+		{Name: "WEBOTS_HOME", Value: home},
+		{Name: "PATH", Value: prepend(home, os.Getenv("PATH")), List: true},
+		{Name: "LD_LIBRARY_PATH", Value: prepend(webotsLibPath(home), os.Getenv("LD_LIBRARY_PATH")), List: true},
+	}
+}
+
+// execWithEnv replaces the current process by the command args,
+// within the environment vars.
+func execWithEnv(vars []EnvVar, args []string) error {
+	for _, v := range vars {
+		if err := os.Setenv(v.Name, v.Value); err != nil {
+			return err
+		}
+	}
+	// PATH is looked up in the new environment
+	bin, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(bin, args, os.Environ())
+}
+
+var supportedShells = []string{"bash", "zsh", "fish"}
+
+// detectShell returns the shell to use for shell, defaulting to the
+// user login shell.
+func detectShell(shell string) (string, error) {
+	if len(shell) == 0 {
+		shell = path.Base(os.Getenv("SHELL"))
+		for _, s := range supportedShells {
+			if s == shell {
+				return s, nil
+			}
+		}
+		return "bash", nil
+	}
+	for _, s := range supportedShells {
+		if s == shell {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("Unsupported shell %s, use one of %s", shell, strings.Join(supportedShells, ", "))
+}
+
+func shQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func fishQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
+
+// formatEnv returns the shell commands exporting vars
+func formatEnv(shell string, vars []EnvVar) string {
+	var res []string
+	for _, v := range vars {
+		switch shell {
+		case "fish":
+			values := []string{fishQuote(v.Value)}
+			if v.List {
+				values = values[:0]
+				for _, p := range strings.Split(v.Value, ":") {
+					values = append(values, fishQuote(p))
+				}
+			}
+			res = append(res, fmt.Sprintf("set -gx %s %s;", v.Name, strings.Join(values, " ")))
+		default:
+			res = append(res, fmt.Sprintf("export %s=%s;", v.Name, shQuote(v.Value)))
+		}
+	}
+	return strings.Join(res, "\n") + "\n"
+}
+
+// managedPaths returns the paths under which versions can be found,
+// including the used one, and the paths under them which are not
+// versions.
+func (m *SymlinkWebotsManager) managedPaths() ([]string, []string) {
+	return []string{m.installpath, m.workpath}, []string{m.shimsPath()}
+}
+
+// Env returns the environment to use version v, or the used version
+// if v is nil.
+func (m *SymlinkWebotsManager) Env(v *WebotsVersion) ([]EnvVar, error) {
+	home, err := m.Home(v)
+	if err != nil {
+		return nil, err
+	}
+	managed, kept := m.managedPaths()
+	return webotsEnv(home, managed, kept), nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWebotsEnvPath(t *testing.T) {
+	managed := []string{"/usr/local/webots", "/var/lib/webots-manager"}
+	kept := []string{"/var/lib/webots-manager/shims"}
+
+	testdata := []struct {
+		current, expected string
+	}{
+		{"/usr/bin", "/usr/local/webots:/usr/bin"},
+		{"/usr/local/webots:/usr/bin", "/usr/local/webots:/usr/bin"},
+		{"/var/lib/webots-manager/8.5.4:/usr/bin", "/usr/local/webots:/usr/bin"},
+		{"/var/lib/webots-manager/8.5.4/:/usr/bin::", "/usr/local/webots:/usr/bin"},
+		{"/var/lib/webots-manager/shims:/usr/bin", "/usr/local/webots:/var/lib/webots-manager/shims:/usr/bin"},
+		{"/var/lib/webots-manager/shims/:/usr/bin", "/usr/local/webots:/var/lib/webots-manager/shims/:/usr/bin"},
+		{"/var/lib/webots-manager-old:/usr/bin", "/usr/local/webots:/var/lib/webots-manager-old:/usr/bin"},
+	}
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	for _, d := range testdata {
+		os.Setenv("PATH", d.current)
+		for _, v := range webotsEnv("/usr/local/webots", managed, kept) {
+			if v.Name == "PATH" && v.Value != d.expected {
+				t.Errorf("Expected PATH %s for %s, got %s", d.expected, d.current, v.Value)
+			}
+		}
+	}
+}
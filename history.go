@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"time"
+)
+
+// UseRecord is a switch of the used version, as stored in the
+// history of the workpath. From is empty if no version was used
+// before.
+type UseRecord struct {
+	Time     time.Time
+	User     string
+	From, To string
+}
+
+func historyPath(workpath string) string {
+	return path.Join(workpath, "history.json")
+}
+
+func loadHistory(workpath string) ([]UseRecord, error) {
+	var res []UseRecord
+	f, err := os.Open(historyPath(workpath))
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	err = dec.Decode(&res)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read history %s: %s", historyPath(workpath), err)
+	}
+	return res, nil
+}
+
+func saveHistory(workpath string, h []UseRecord) error {
+	f, err := os.Create(historyPath(workpath))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	return enc.Encode(h)
+}
+
+func currentUserName() string {
+	if sudoUser := os.Getenv("SUDO_USER"); len(sudoUser) != 0 {
+		return sudoUser
+	}
+	u, err := user.Current()
+	if err != nil {
+		return fmt.Sprintf("uid=%d", os.Getuid())
+	}
+	return u.Username
+}
+
+// recordUse appends a switch to the history of workpath. Using again
+// the used version is not a switch, and is not recorded.
+func recordUse(workpath string, from *WebotsVersion, to WebotsVersion) error {
+	if from != nil && *from == to {
+		return nil
+	}
+
+	h, err := loadHistory(workpath)
+	if err != nil {
+		return err
+	}
+
+	r := UseRecord{
+		Time: time.Now(),
+		User: currentUserName(),
+		To:   to.String(),
+	}
+	if from != nil {
+		r.From = from.String()
+	}
+
+	return saveHistory(workpath, append(h, r))
+}
+
+func (m *SymlinkWebotsManager) History() ([]UseRecord, error) {
+	if err := m.tryRLock(); err != nil {
+		return nil, err
+	}
+	defer m.unlock()
+
+	return loadHistory(m.workpath)
+}
+
+// Rollback uses again the version that was used before the last
+// steps switches. The rollback is itself recorded in the history, so
+// two consecutive rollbacks go back to the initial version.
+func (m *SymlinkWebotsManager) Rollback(steps int) (WebotsVersion, error) {
+	if err := m.tryLock(); err != nil {
+		return WebotsVersion{}, err
+	}
+	defer m.unlock()
+
+	if steps <= 0 {
+		return WebotsVersion{}, fmt.Errorf("Invalid number of steps %d", steps)
+	}
+
+	h, err := loadHistory(m.workpath)
+	if err != nil {
+		return WebotsVersion{}, err
+	}
+	if steps > len(h) {
+		return WebotsVersion{}, fmt.Errorf("Cannot rollback %d steps, only %d switches are recorded", steps, len(h))
+	}
+
+	r := h[len(h)-steps]
+	if len(r.From) == 0 {
+		return WebotsVersion{}, fmt.Errorf("No version was used before switching to %s on %s", r.To, r.Time.Format(time.RFC1123))
+	}
+
+	v, err := ParseWebotsVersion(r.From)
+	if err != nil {
+		return WebotsVersion{}, err
+	}
+
+	found := false
+	for _, vv := range m.installed {
+		if vv == v {
+			found = true
+			break
+		}
+	}
+	if found == false {
+		return WebotsVersion{}, fmt.Errorf("Cannot rollback to %s, it is not installed anymore", v)
+	}
+
+	return v, m.use(v)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRecordUse(t *testing.T) {
+	workpath, err := ioutil.TempDir("", "webots-manager-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workpath)
+
+	v854 := WebotsVersion{Major: 8, Minor: 5, Patch: 4}
+	v860 := WebotsVersion{Major: 8, Minor: 6, Patch: 0}
+	testdata := []struct {
+		from     *WebotsVersion
+		to       WebotsVersion
+		recorded int
+	}{
+		{nil, v854, 1},
+		{&v854, v854, 1},
+		{&v854, v860, 2},
+		{&v860, v860, 2},
+		{&v860, v854, 3},
+	}
+
+	for _, d := range testdata {
+		if err := recordUse(workpath, d.from, d.to); err != nil {
+			t.Fatal(err)
+		}
+		h, err := loadHistory(workpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(h) != d.recorded {
+			t.Errorf("Expected %d records after using %s, got %d", d.recorded, d.to, len(h))
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// worldHeaderRx matches the first line of a world file, e.g.
+// #VRML_SIM V8.5.4 utf8 or #VRML_SIM V8.5 utf8
+var worldHeaderRx = regexp.MustCompile(`^#VRML_SIM V([0-9]+\.[0-9]+(\.[0-9]+)?)\b`)
+
+// worldVersion reads the version required by a world file
+func worldVersion(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && len(line) == 0 {
+		return "", err
+	}
+	m := worldHeaderRx.FindStringSubmatch(line)
+	if m == nil {
+		return "", fmt.Errorf("World %s has no version header", p)
+	}
+	return m[1], nil
+}
+
+// projectWorld returns the first world of a webots project, either
+// in dir or in its worlds subdirectory.
+func projectWorld(dir string) (string, bool) {
+	for _, d := range []string{path.Join(dir, "worlds"), dir} {
+		files, err := ioutil.ReadDir(d)
+		if err != nil {
+			continue
+		}
+		var worlds []string
+		for _, fi := range files {
+			if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".wbt") {
+				worlds = append(worlds, path.Join(d, fi.Name()))
+			}
+		}
+		if len(worlds) != 0 {
+			sort.Strings(worlds)
+			return worlds[0], true
+		}
+	}
+	return "", false
+}
+
+// findProjectVersion looks in dir and its parents for the version
+// required by a project: a pin file, or the header of the project
+// worlds. It returns an empty version if there is none.
+func findProjectVersion(dir string) (string, string, error) {
+	for {
+		p := path.Join(dir, pinFileName)
+		if _, err := os.Stat(p); err == nil {
+			v, err := readPinFile(p)
+			if err != nil {
+				return "", "", err
+			}
+			return v.String(), p, nil
+		}
+		if w, ok := projectWorld(dir); ok {
+			if v, err := worldVersion(w); err == nil {
+				return v, w, nil
+			}
+		}
+		parent := path.Dir(dir)
+		if parent == dir {
+			return "", "", nil
+		}
+		dir = parent
+	}
+}
+
+// hookScript returns the shell code installing a hook which updates
+// the environment when the current directory changes.
+func hookScript(shell, self string) string {
+	switch shell {
+	case "zsh":
+		return fmt.Sprintf(`_webots_manager_hook() {
+  eval "$(%s hook-env --shell zsh)"
+}
+autoload -Uz add-zsh-hook
+add-zsh-hook chpwd _webots_manager_hook
+_webots_manager_hook
+`, self)
+	case "fish":
+		return fmt.Sprintf(`function _webots_manager_hook --on-variable PWD
+    %s hook-env --shell fish | source
+end
+_webots_manager_hook
+`, self)
+	}
+	return fmt.Sprintf(`_webots_manager_hook() {
+  local previous_exit_status=$?
+  if [ "$PWD" != "$_WEBOTS_MANAGER_LAST_PWD" ]; then
+    _WEBOTS_MANAGER_LAST_PWD="$PWD"
+    eval "$(%s hook-env --shell bash)"
+  fi
+  return $previous_exit_status
+}
+if [[ ";${PROMPT_COMMAND:-};" != *";_webots_manager_hook;"* ]]; then
+  PROMPT_COMMAND="_webots_manager_hook${PROMPT_COMMAND:+;$PROMPT_COMMAND}"
+fi
+`, self)
+}
+
+// HookEnv returns the environment for the version required in dir.
+// If the required version is not installed, a warning is returned
+// instead, and the environment should be left as is.
+func (m *SymlinkWebotsManager) HookEnv(dir string) ([]EnvVar, string, error) {
+	spec, source, err := ResolveVersion(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	v, err := resolveSpec(spec, m.installed)
+	if err != nil {
+		install := spec
+		if partialVersionRx.MatchString(spec) {
+			install = spec + ".X"
+		}
+		self, serr := selfCommand()
+		if serr != nil {
+			self = "webots-manager"
+		}
+		return nil, fmt.Sprintf("webots-manager: %s, required by %s. To install it, run:\n  %s install %s", err, source, self, install), nil
+	}
+	vars, err := m.Env(v)
+	return vars, "", err
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FileLock is a lock shared between processes, based on flock(2). It
+// can be hold exclusively, or shared by several readers. As the
+// kernel releases the lock of a crashed process, only the holder
+// information (stored next to the lock) can become stale.
+//
+// A FileLock is reentrant within a process, but a shared lock cannot
+// be upgraded: as two readers upgrading would deadlock, the exclusive
+// lock must be taken up front.
+type FileLock struct {
+	path      string
+	file      *os.File
+	count     int
+	exclusive bool
+}
+
+// LockHolder describes a process holding a FileLock
+type LockHolder struct {
+	Pid     int
+	User    string
+	Command string
+	Since   time.Time
+	Shared  bool
+}
+
+func (h LockHolder) String() string {
+	mode := "exclusively"
+	if h.Shared {
+		mode = "shared"
+	}
+	return fmt.Sprintf("PID %d (%s: '%s') %s since %s",
+		h.Pid, h.User, h.Command, mode, h.Since.Format("2006-01-02 15:04:05"))
+}
+
+func (h LockHolder) alive() bool {
+	err := syscall.Kill(h.Pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+const lockPollPeriod = 100 * time.Millisecond
+
+func NewFileLock(p string) (*FileLock, error) {
+	if path.IsAbs(p) == false {
+		return nil, fmt.Errorf("Lock %s must be an absolute path", p)
+	}
+	return &FileLock{path: p}, nil
+}
+
+func (l *FileLock) String() string {
+	return l.path
+}
+
+func (l *FileLock) holdersPath() string {
+	return l.path + ".holders"
+}
+
+// Lock acquires the lock exclusively, waiting at most
+// options.LockTimeout.
+func (l *FileLock) Lock() error {
+	return l.acquire(true)
+}
+
+// RLock acquires the lock shared with other readers, waiting at most
+// options.LockTimeout.
+func (l *FileLock) RLock() error {
+	return l.acquire(false)
+}
+
+func (l *FileLock) acquire(exclusive bool) error {
+	if l.count > 0 && (l.exclusive || exclusive == false) {
+		l.count++
+		return nil
+	}
+	if l.count > 0 {
+		return fmt.Errorf("Internal error, lock %s is hold shared and cannot be upgraded", l.path)
+	}
+
+	if l.file == nil {
+		f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0664)
+		if err != nil {
+			return fmt.Errorf("Could not open lock %s: %s", l.path, err)
+		}
+		l.file = f
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	fail := func(err error) error {
+		l.release()
+		return err
+	}
+
+	deadline := time.Now().Add(options.LockTimeout)
+	warned := false
+	for {
+		err := syscall.Flock(int(l.file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			return fail(fmt.Errorf("Could not lock %s: %s", l.path, err))
+		}
+
+		holders, _ := l.Holders()
+		if time.Now().After(deadline) {
+			return fail(fmt.Errorf("Could not lock %s within %s, %s", l.path, options.LockTimeout, describeHolders(holders)))
+		}
+		if warned == false {
+			fmt.Fprintf(os.Stderr, "Waiting for lock %s, %s\n", l.path, describeHolders(holders))
+			warned = true
+		}
+		time.Sleep(lockPollPeriod)
+	}
+
+	l.exclusive = exclusive
+	if err := l.writeHolder(); err != nil {
+		return fail(err)
+	}
+	l.count++
+	return nil
+}
+
+func describeHolders(holders []LockHolder) string {
+	if len(holders) == 0 {
+		return "held by an unknown process"
+	}
+	desc := make([]string, 0, len(holders))
+	for _, h := range holders {
+		desc = append(desc, h.String())
+	}
+	return "held by " + strings.Join(desc, ", ")
+}
+
+// Unlock releases one level of the lock.
+func (l *FileLock) Unlock() error {
+	if l.count == 0 {
+		return fmt.Errorf("Lock %s is not hold", l.path)
+	}
+	l.count--
+	if l.count > 0 {
+		return nil
+	}
+	os.Remove(path.Join(l.holdersPath(), strconv.Itoa(os.Getpid())))
+	return l.release()
+}
+
+func (l *FileLock) release() error {
+	if l.file == nil {
+		return nil
+	}
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	l.file = nil
+	l.exclusive = false
+	return err
+}
+
+func (l *FileLock) writeHolder() error {
+	dir := l.holdersPath()
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	os.Chmod(dir, 0775|os.ModeSetgid)
+	h := LockHolder{
+		Pid:     os.Getpid(),
+		User:    currentUserName(),
+		Command: strings.Join(os.Args, " "),
+		Since:   time.Now(),
+		Shared:  l.exclusive == false,
+	}
+	data, err := json.Marshal(&h)
+	if err != nil {
+		return err
+	}
+	p := path.Join(dir, strconv.Itoa(h.Pid))
+	if err := ioutil.WriteFile(p, data, 0664); err != nil {
+		return err
+	}
+	return os.Chmod(p, 0664)
+}
+
+// Holders returns the processes currently holding the lock. Stale
+// holder information left by crashed processes is removed.
+func (l *FileLock) Holders() ([]LockHolder, error) {
+	holders, stale, err := l.readHolders()
+	for _, h := range stale {
+		fmt.Fprintf(os.Stderr, "Removing stale lock information of crashed process %s\n", h)
+		os.Remove(path.Join(l.holdersPath(), strconv.Itoa(h.Pid)))
+	}
+	return holders, err
+}
+
+// readHolders reads holder information, separating information of
+// processes that still exists from stale one.
+func (l *FileLock) readHolders() ([]LockHolder, []LockHolder, error) {
+	files, err := ioutil.ReadDir(l.holdersPath())
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var holders, stale []LockHolder
+	for _, fi := range files {
+		data, err := ioutil.ReadFile(path.Join(l.holdersPath(), fi.Name()))
+		if err != nil {
+			continue
+		}
+		h := LockHolder{}
+		if err := json.Unmarshal(data, &h); err != nil {
+			continue
+		}
+		if h.alive() && h.Pid != os.Getpid() {
+			holders = append(holders, h)
+		} else if h.Pid != os.Getpid() {
+			stale = append(stale, h)
+		}
+	}
+	return holders, stale, nil
+}
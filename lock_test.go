@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webots-manager-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// flock(2) locks of different open files conflict, even within a
+	// process, so each FileLock acts as another process.
+	p := path.Join(dir, "global.lock")
+	a, err := NewFileLock(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewFileLock(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testdata := []struct {
+		name     string
+		run      func() error
+		expected bool
+	}{
+		{"a shared", a.RLock, true},
+		{"b shared with a", b.RLock, true},
+		{"b shared again", b.RLock, true},
+		{"a upgrade", a.Lock, false},
+		{"a still shared", a.RLock, true},
+		{"a release", a.Unlock, true},
+		{"a release", a.Unlock, true},
+		{"a exclusive while b is shared", a.Lock, false},
+		{"b release", b.Unlock, true},
+		{"b release", b.Unlock, true},
+		{"b release not hold", b.Unlock, false},
+		{"a exclusive", a.Lock, true},
+		{"a reentrant shared", a.RLock, true},
+		{"a reentrant exclusive", a.Lock, true},
+		{"b shared while a is exclusive", b.RLock, false},
+		{"b exclusive while a is exclusive", b.Lock, false},
+		{"a release", a.Unlock, true},
+		{"a release", a.Unlock, true},
+		{"a release", a.Unlock, true},
+		{"b exclusive", b.Lock, true},
+		{"b release", b.Unlock, true},
+	}
+
+	for _, d := range testdata {
+		err := d.run()
+		if d.expected && err != nil {
+			t.Fatalf("%s: unexpected error: %s", d.name, err)
+		}
+		if d.expected == false && err == nil {
+			t.Fatalf("%s: should fail", d.name)
+		}
+	}
+}
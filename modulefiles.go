@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Modulefiles for Environment Modules (tcl) or Lmod (lua) are
+// generated in registered directories, as DIR/webots/VERSION, and
+// regenerated each time installed versions change.
+
+type ModulefileTarget struct {
+	Dir    string
+	Format string
+}
+
+const (
+	modulefilesName   = "webots"
+	modulefilesMarker = "generated by webots-manager, do not edit"
+)
+
+var modulefileFormats = []string{"tcl", "lua"}
+
+func (m *SymlinkWebotsManager) modulefilesConfigPath() string {
+	return path.Join(m.workpath, "modulefiles.json")
+}
+
+func (m *SymlinkWebotsManager) loadModulefileTargets() ([]ModulefileTarget, error) {
+	var res []ModulefileTarget
+	f, err := os.Open(m.modulefilesConfigPath())
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&res); err != nil {
+		return nil, fmt.Errorf("Could not read %s: %s", m.modulefilesConfigPath(), err)
+	}
+	return res, nil
+}
+
+func (m *SymlinkWebotsManager) saveModulefileTargets(targets []ModulefileTarget) error {
+	f, err := os.Create(m.modulefilesConfigPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(targets)
+}
+
+func absPath(p string) (string, error) {
+	if path.IsAbs(p) {
+		return path.Clean(p), nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(wd, p), nil
+}
+
+func modulefileName(v WebotsVersion, format string) string {
+	if format == "lua" {
+		return v.String() + ".lua"
+	}
+	return v.String()
+}
+
+func modulefileContent(v WebotsVersion, home, format string) string {
+	if format == "lua" {
+		return fmt.Sprintf(`-- %s
+whatis("Webots robot simulator %s")
+family("webots")
+setenv("WEBOTS_HOME", %q)
+prepend_path("PATH", %q)
+prepend_path("LD_LIBRARY_PATH", %q)
+`, modulefilesMarker, v, home, home, webotsLibPath(home))
+	}
+	return fmt.Sprintf(`#%%Module1.0
+## %s
+proc ModulesHelp { } {
+    puts stderr "Webots robot simulator %s"
+}
+module-whatis "Webots robot simulator %s"
+conflict %s
+setenv WEBOTS_HOME {%s}
+prepend-path PATH {%s}
+prepend-path LD_LIBRARY_PATH {%s}
+`, modulefilesMarker, v, v, modulefilesName, home, home, webotsLibPath(home))
+}
+
+// generateModulefiles writes the modulefiles of all installed
+// versions in t, and removes the ones of uninstalled versions. The
+// used version is the default one.
+func (m *SymlinkWebotsManager) generateModulefiles(t ModulefileTarget) error {
+	dir := path.Join(t.Dir, modulefilesName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	expected := make(map[string]bool)
+	for _, v := range m.installed {
+		name := modulefileName(v, t.Format)
+		expected[name] = true
+		content := modulefileContent(v, path.Join(m.workpath, v.String()), t.Format)
+		if err := writeUnshared(path.Join(dir, name), strings.NewReader(content), 0644); err != nil {
+			return err
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if expected[fi.Name()] || fi.Mode().IsRegular() == false {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(dir, fi.Name()))
+		if err != nil || strings.Contains(string(content), modulefilesMarker) == false {
+			continue
+		}
+		if err := os.Remove(path.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+
+	if t.Format == "lua" {
+		def := path.Join(dir, "default")
+		if _, err := os.Lstat(def); err == nil {
+			if err := os.Remove(def); err != nil {
+				return err
+			}
+		}
+		if m.inUse != nil {
+			return os.Symlink(modulefileName(*m.inUse, t.Format), def)
+		}
+		return nil
+	}
+
+	versionFile := path.Join(dir, ".version")
+	if m.inUse == nil {
+		os.Remove(versionFile)
+		return nil
+	}
+	content := fmt.Sprintf("#%%Module1.0\n## %s\nset ModulesVersion \"%s\"\n", modulefilesMarker, *m.inUse)
+	return writeUnshared(versionFile, strings.NewReader(content), 0644)
+}
+
+// GenerateModulefiles generates modulefiles in dir, and registers it
+// so modulefiles are kept in sync with installed versions.
+func (m *SymlinkWebotsManager) GenerateModulefiles(dir, format string) error {
+	if err := m.tryLock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+
+	valid := false
+	for _, f := range modulefileFormats {
+		valid = valid || f == format
+	}
+	if valid == false {
+		return fmt.Errorf("Unsupported modulefile format %s, use one of %s", format, strings.Join(modulefileFormats, ", "))
+	}
+	dir, err := absPath(dir)
+	if err != nil {
+		return err
+	}
+
+	t := ModulefileTarget{Dir: dir, Format: format}
+	if err := m.generateModulefiles(t); err != nil {
+		return err
+	}
+
+	targets, err := m.loadModulefileTargets()
+	if err != nil {
+		return err
+	}
+	for i, tt := range targets {
+		if tt.Dir == t.Dir {
+			targets[i] = t
+			return m.saveModulefileTargets(targets)
+		}
+	}
+	return m.saveModulefileTargets(append(targets, t))
+}
+
+// ForgetModulefiles stops keeping modulefiles of dir in sync. Existing
+// modulefiles are kept.
+func (m *SymlinkWebotsManager) ForgetModulefiles(dir string) error {
+	if err := m.tryLock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+
+	dir, err := absPath(dir)
+	if err != nil {
+		return err
+	}
+	targets, err := m.loadModulefileTargets()
+	if err != nil {
+		return err
+	}
+	res := targets[:0]
+	for _, t := range targets {
+		if t.Dir != dir {
+			res = append(res, t)
+		}
+	}
+	if len(res) == len(targets) {
+		return fmt.Errorf("Modulefiles in %s are not generated", dir)
+	}
+	return m.saveModulefileTargets(res)
+}
+
+// updateModulefiles regenerates modulefiles in all registered
+// directories.
+func (m *SymlinkWebotsManager) updateModulefiles() error {
+	targets, err := m.loadModulefileTargets()
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		if err := m.generateModulefiles(t); err != nil {
+			return fmt.Errorf("Could not update modulefiles in %s: %s", t.Dir, err)
+		}
+	}
+	return nil
+}
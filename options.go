@@ -1,8 +1,20 @@
 package main
 
-import "github.com/jessevdk/go-flags"
+import (
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
 
 type Options struct {
+	Root        string        `long:"root" env:"WEBOTS_MANAGER_ROOT" default:"/usr/local" description:"root of the installation, versions are stored in ROOT/webots-manager and used from ROOT/webots"`
+	User        bool          `long:"user" env:"WEBOTS_MANAGER_USER" description:"use a per-user store in $XDG_DATA_HOME/webots-manager, not requiring any administrative rights"`
+	Archives    []string      `long:"archive" default:"http://www.cyberbotics.com/archive/" description:"URL of a webots archive, can be repeated. Earlier archives have priority"`
+	Arch        string        `long:"arch" description:"architecture of installed versions (i386 or x86-64), defaults to the system one"`
+	HttpTimeout time.Duration `long:"http-timeout" default:"30s" description:"timeout to connect and get response from archives"`
+	HttpProxy   string        `long:"http-proxy" description:"proxy URL to reach archives, defaults to the HTTP_PROXY environment"`
+	Keep        int           `long:"keep" default:"0" description:"number of versions kept after an installation, older unused versions are removed. 0 keeps all versions"`
+	LockTimeout time.Duration `long:"lock-timeout" env:"WEBOTS_MANAGER_LOCK_TIMEOUT" default:"30s" description:"how long to wait for a lock held by another process"`
 }
 
 var options = &Options{}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Patch templates are unified diffs of a single file, applied to the
+// file shipped in each version. Like patch(1), a hunk is searched
+// around its expected line, and with up to maxPatchFuzz context lines
+// ignored, so small upstream changes do not break it.
+
+const (
+	PatchClean  = "clean"
+	PatchFuzz   = "fuzz"
+	PatchFailed = "failed"
+
+	maxPatchFuzz = 2
+)
+
+type patchHunk struct {
+	oldStart, oldCount int
+	// lines are prefixed by ' ', '-' or '+', and keep their newline
+	lines []string
+}
+
+var hunkHeaderRx = regexp.MustCompile(`^@@ -([0-9]+)(?:,([0-9]+))? \+([0-9]+)(?:,([0-9]+))? @@`)
+
+func parseCount(s string) int {
+	if len(s) == 0 {
+		return 1
+	}
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// parsePatch parses the hunks of a unified diff of a single file
+func parsePatch(data []byte) ([]patchHunk, error) {
+	var res []patchHunk
+	lines := strings.SplitAfter(string(data), "\n")
+	files := 0
+	for i := 0; i < len(lines); i++ {
+		l := lines[i]
+		if strings.HasPrefix(l, "--- ") {
+			files++
+			if files > 1 {
+				return nil, fmt.Errorf("Patch modifies several files, only one is supported")
+			}
+			continue
+		}
+		m := hunkHeaderRx.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		h := patchHunk{
+			oldStart: parseCount(m[1]),
+			oldCount: parseCount(m[2]),
+		}
+		oldLeft, newLeft := h.oldCount, parseCount(m[4])
+		for oldLeft > 0 || newLeft > 0 {
+			i++
+			if i >= len(lines) || len(lines[i]) == 0 {
+				return nil, fmt.Errorf("Truncated hunk at line %d of patch", i)
+			}
+			l := lines[i]
+			if l == "\n" {
+				// some editors strip the space of empty context lines
+				l = " \n"
+			}
+			switch l[0] {
+			case ' ':
+				oldLeft--
+				newLeft--
+			case '-':
+				oldLeft--
+			case '+':
+				newLeft--
+			case '\\':
+				noNewline(&h)
+				continue
+			default:
+				return nil, fmt.Errorf("Invalid line %d of patch: %q", i+1, strings.TrimSuffix(l, "\n"))
+			}
+			if oldLeft < 0 || newLeft < 0 {
+				return nil, fmt.Errorf("Hunk at line %d of patch is longer than its header", i+1)
+			}
+			h.lines = append(h.lines, l)
+		}
+		// "\ No newline at end of file" of the last line
+		if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "\\") {
+			i++
+			noNewline(&h)
+		}
+		res = append(res, h)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("Patch does not contain any hunk")
+	}
+	return res, nil
+}
+
+func noNewline(h *patchHunk) {
+	if len(h.lines) != 0 {
+		h.lines[len(h.lines)-1] = strings.TrimSuffix(h.lines[len(h.lines)-1], "\n")
+	}
+}
+
+// sides returns the lines the hunk expects and the lines it writes,
+// ignoring up to fuzz context lines at both ends, and how many leading
+// ones were ignored.
+func (h patchHunk) sides(fuzz int) ([]string, []string, int) {
+	lead, trail := 0, 0
+	for lead < fuzz && lead < len(h.lines) && h.lines[lead][0] == ' ' {
+		lead++
+	}
+	for trail < fuzz && trail < len(h.lines)-lead && h.lines[len(h.lines)-1-trail][0] == ' ' {
+		trail++
+	}
+	var before, after []string
+	for _, l := range h.lines[lead : len(h.lines)-trail] {
+		if l[0] != '+' {
+			before = append(before, l[1:])
+		}
+		if l[0] != '-' {
+			after = append(after, l[1:])
+		}
+	}
+	return before, after, lead
+}
+
+func matchesAt(lines, expected []string, at int) bool {
+	if at < 0 || at+len(expected) > len(lines) {
+		return false
+	}
+	for i, l := range expected {
+		if lines[at+i] != l {
+			return false
+		}
+	}
+	return true
+}
+
+// applyPatch applies hunks to content. It returns the patched content,
+// and a note for each hunk that did not apply at its exact place.
+func applyPatch(content []byte, hunks []patchHunk) ([]byte, []string, error) {
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	var res, notes []string
+	pos, offset := 0, 0
+	for n, h := range hunks {
+		applied := false
+		for fuzz := 0; fuzz <= maxPatchFuzz && applied == false; fuzz++ {
+			before, after, lead := h.sides(fuzz)
+			start := h.oldStart - 1
+			if h.oldCount == 0 {
+				start = h.oldStart
+			}
+			expected := start + lead + offset
+			// searches the nearest place, first after then before
+			for d := 0; d <= len(lines); d++ {
+				at := -1
+				if expected+d >= pos && matchesAt(lines, before, expected+d) {
+					at = expected + d
+				} else if d != 0 && expected-d >= pos && matchesAt(lines, before, expected-d) {
+					at = expected - d
+				}
+				if at < 0 {
+					continue
+				}
+				if fuzz != 0 {
+					notes = append(notes, fmt.Sprintf("hunk %d applied with fuzz %d", n+1, fuzz))
+				} else if at != expected {
+					notes = append(notes, fmt.Sprintf("hunk %d applied with offset %d lines", n+1, at-expected))
+				}
+				res = append(append(res, lines[pos:at]...), after...)
+				pos = at + len(before)
+				offset = at - start - lead
+				applied = true
+				break
+			}
+		}
+		if applied == false {
+			return nil, notes, fmt.Errorf("hunk %d does not apply", n+1)
+		}
+	}
+	res = append(res, lines[pos:]...)
+	return []byte(strings.Join(res, "")), notes, nil
+}
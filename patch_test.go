@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyPatch(t *testing.T) {
+	original := "a\nb\nc\nd\ne\nf\ng\nh\n"
+	twoHunks := "--- a/x\n+++ b/x\n@@ -2,3 +2,3 @@\n b\n-c\n+C\n d\n@@ -6,2 +6,3 @@\n f\n g\n+G\n"
+	noNewline := "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b2\n\\ No newline at end of file\n"
+
+	testdata := []struct {
+		name, patch, content, expected string
+		note                           string
+		fails                          bool
+	}{
+		{"clean", twoHunks, original, "a\nb\nC\nd\ne\nf\ng\nG\nh\n", "", false},
+		{"offset", twoHunks, "0\n1\n" + original, "0\n1\na\nb\nC\nd\ne\nf\ng\nG\nh\n", "offset 2 lines", false},
+		{"fuzz", twoHunks, "a\nB\nc\nd\ne\nf\ng\nh\n", "a\nB\nC\nd\ne\nf\ng\nG\nh\n", "fuzz 1", false},
+		{"no newline", noNewline, "a\nb", "a\nb2", "", false},
+		{"insertion at start", "@@ -0,0 +1 @@\n+top\n", original, "top\n" + original, "", false},
+		{"conflict", twoHunks, "a\nb\nx\nd\n", "", "", true},
+	}
+
+	for _, d := range testdata {
+		hunks, err := parsePatch([]byte(d.patch))
+		if err != nil {
+			t.Errorf("%s: unexpected parse error: %s", d.name, err)
+			continue
+		}
+		res, notes, err := applyPatch([]byte(d.content), hunks)
+		if d.fails {
+			if err == nil {
+				t.Errorf("%s: should fail, got %q", d.name, res)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.name, err)
+			continue
+		}
+		if string(res) != d.expected {
+			t.Errorf("%s: expected %q, got %q", d.name, d.expected, res)
+		}
+		if len(d.note) == 0 && len(notes) != 0 {
+			t.Errorf("%s: unexpected notes %v", d.name, notes)
+		}
+		if len(d.note) != 0 && (len(notes) != 1 || strings.Contains(notes[0], d.note) == false) {
+			t.Errorf("%s: expected a note about %s, got %v", d.name, d.note, notes)
+		}
+	}
+}
+
+func TestParsePatchErrors(t *testing.T) {
+	for _, p := range []string{"", "hello", "@@ -1,2 +1,2 @@\n a\n"} {
+		if _, err := parsePatch([]byte(p)); err == nil {
+			t.Errorf("Invalid patch %q was accepted", p)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Shims are small scripts in the shims directory, named after the
+// executables provided by installed versions. Each of them calls
+// back webots-manager, which resolves the version to use for this
+// invocation and executes the right binary.
+
+const (
+	versionEnvVar  = "WEBOTS_MANAGER_VERSION"
+	pinFileName    = ".webots-version"
+	shimSubdir     = "shims"
+	shimMarker     = "# generated by webots-manager rehash, do not edit"
+	userPinName    = "webots-manager.version"
+	executableMask = 0111
+)
+
+// executableDirs are the directories, relative to a version, whose
+// executables get a shim.
+var executableDirs = []string{".", "bin"}
+
+func (m *SymlinkWebotsManager) shimsPath() string {
+	return path.Join(m.workpath, shimSubdir)
+}
+
+// listExecutables returns the executables provided by an installed
+// version, by name, with their path relative to the version.
+func listExecutables(root string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, d := range executableDirs {
+		files, err := ioutil.ReadDir(path.Join(root, d))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range files {
+			p := path.Join(d, fi.Name())
+			// follow symlinks, some entry points are links to bin
+			st, err := os.Stat(path.Join(root, p))
+			if err != nil || st.Mode().IsRegular() == false || st.Mode()&executableMask == 0 {
+				continue
+			}
+			if _, ok := res[fi.Name()]; ok == false {
+				res[fi.Name()] = p
+			}
+		}
+	}
+	return res, nil
+}
+
+// selfCommand returns the shell command calling back the current
+// executable on the same store.
+func selfCommand() (string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if options.User {
+		return shQuote(self) + " --user", nil
+	}
+	return shQuote(self) + " --root " + shQuote(options.Root), nil
+}
+
+// shimScript returns the content of the shim of name
+func shimScript(self, name string) string {
+	return fmt.Sprintf("#!/bin/sh\n%s\nexec %s shim-exec %s -- \"$@\"\n",
+		shimMarker, self, shQuote(name))
+}
+
+// Rehash regenerates the shims for all executables of installed
+// versions.
+func (m *SymlinkWebotsManager) Rehash() ([]string, error) {
+	if err := m.tryLock(); err != nil {
+		return nil, err
+	}
+	defer m.unlock()
+	return m.rehash()
+}
+
+func (m *SymlinkWebotsManager) rehash() ([]string, error) {
+	names := make(map[string]bool)
+	for _, v := range m.installed {
+		exes, err := listExecutables(path.Join(m.workpath, v.String()))
+		if err != nil {
+			return nil, err
+		}
+		for n := range exes {
+			names[n] = true
+		}
+	}
+
+	self, err := selfCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := m.shimsPath()
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return nil, err
+	}
+
+	// remove shims of executables that are not provided anymore
+	existing, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range existing {
+		if names[fi.Name()] {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(dir, fi.Name()))
+		if err != nil || strings.Contains(string(content), shimMarker) == false {
+			continue
+		}
+		if err := os.Remove(path.Join(dir, fi.Name())); err != nil {
+			return nil, err
+		}
+	}
+
+	res := make([]string, 0, len(names))
+	for n := range names {
+		err := writeUnshared(path.Join(dir, n), strings.NewReader(shimScript(self, n)), 0775)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func userPinPath() (string, error) {
+	p, err := userConfigPath()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(path.Dir(p), userPinName), nil
+}
+
+func readPinFile(p string) (WebotsVersion, error) {
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		return WebotsVersion{}, err
+	}
+	v, err := ParseWebotsVersion(strings.TrimSpace(string(content)))
+	if err != nil {
+		return WebotsVersion{}, fmt.Errorf("Invalid pin file %s: %s", p, err)
+	}
+	return v, nil
+}
+
+// ResolveVersion returns the version to use from dir: from the
+// WEBOTS_MANAGER_VERSION environment variable, the project (see
+// findProjectVersion), the per-user choice, and finally the used
+// version. It returns the required version, which may be partial like
+// 8.5, and where it comes from. An empty version means the used one.
+func ResolveVersion(dir string) (string, string, error) {
+	if s := os.Getenv(versionEnvVar); len(s) != 0 {
+		if _, err := ParseWebotsVersion(s); err != nil {
+			return "", "", fmt.Errorf("Invalid %s: %s", versionEnvVar, err)
+		}
+		return s, versionEnvVar, nil
+	}
+
+	spec, source, err := findProjectVersion(dir)
+	if err != nil || len(spec) != 0 {
+		return spec, source, err
+	}
+
+	if p, err := userPinPath(); err == nil {
+		v, err := readPinFile(p)
+		if err == nil {
+			return v.String(), p, nil
+		}
+		if os.IsNotExist(err) == false {
+			return "", "", err
+		}
+	}
+
+	return "", "used version", nil
+}
+
+var partialVersionRx = regexp.MustCompile(`^([0-9]+)\.([0-9]+)$`)
+
+// resolveSpec returns the installed version matching a required
+// version. A partial version like 8.5 matches the latest installed
+// 8.5 patch. An empty spec is the used version, returned as nil.
+func resolveSpec(spec string, installed []WebotsVersion) (*WebotsVersion, error) {
+	if len(spec) == 0 {
+		return nil, nil
+	}
+	if v, err := ParseWebotsVersion(spec); err == nil {
+		for _, vv := range installed {
+			if vv == v {
+				return &v, nil
+			}
+		}
+		return nil, fmt.Errorf("Version %s is not installed", v)
+	}
+
+	m := partialVersionRx.FindStringSubmatch(spec)
+	if m == nil {
+		return nil, fmt.Errorf("Invalid version syntax %s", spec)
+	}
+	var res *WebotsVersion
+	for i := range installed {
+		v := installed[i]
+		if fmt.Sprintf("%d.%d", v.Major, v.Minor) != spec {
+			continue
+		}
+		if res == nil || v.Patch > res.Patch {
+			res = &v
+		}
+	}
+	if res == nil {
+		return nil, fmt.Errorf("No %s.x version is installed", spec)
+	}
+	return res, nil
+}
+
+// ShimExec executes the executable name of the version resolved from
+// the current directory.
+func (m *SymlinkWebotsManager) ShimExec(name string, args []string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	spec, source, err := ResolveVersion(wd)
+	if err != nil {
+		return err
+	}
+	v, err := resolveSpec(spec, m.installed)
+	if err != nil {
+		return fmt.Errorf("%s (required by %s)", err, source)
+	}
+
+	if v == nil && m.inUse == nil {
+		return fmt.Errorf("No version is used, please use or pin one to run %s", name)
+	}
+	home, err := m.Home(v)
+	if err != nil {
+		return err
+	}
+	exes, err := listExecutables(home)
+	if err != nil {
+		return err
+	}
+	rel, ok := exes[name]
+	if ok == false {
+		return fmt.Errorf("Webots in %s (required by %s) does not provide %s", home, source, name)
+	}
+
+	managed, kept := m.managedPaths()
+	return execWithEnv(webotsEnv(home, managed, kept), append([]string{path.Join(home, rel)}, args...))
+}
+
+// PinVersion writes a pin file, or removes it if v is nil.
+func PinVersion(p string, v *WebotsVersion) error {
+	if v == nil {
+		err := os.Remove(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+	log.Printf("Pinned %s in %s", *v, p)
+	return ioutil.WriteFile(p, []byte(v.String()+"\n"), 0644)
+}
@@ -6,30 +6,163 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path"
-
-	"github.com/nightlyone/lockfile"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/template"
 )
 
 type TemplateManager interface {
 	RegisterTemplate(filepath, installpath string) error
 	RemoveTemplate(installpath string) error
-	WhiteList(installpath string, vers []WebotsVersion) error
-	BlackList(installpath string, vers []WebotsVersion) error
+	UpdateTemplate(filepath, installpath string) error
+	CollectGarbage() error
+	WhiteList(installpath string, rules []VersionConstraint) error
+	BlackList(installpath string, rules []VersionConstraint) error
+	Render(installpath string, vars map[string]string) error
+	Copy(installpath string) error
+	Override(installpath string) error
+	Patch(installpath string) error
+	ForgetVersion(v WebotsVersion) error
+	TemplateBackup(installpath string, v WebotsVersion, rel string) (string, bool, error)
 
 	ApplyTemplates(basepath string, v WebotsVersion) error
+	TrackedFiles() (map[string]bool, error)
+
+	Templates() []Template
+	TemplatesFor(v WebotsVersion) []Template
+	TemplateFiles(installpath string) ([]string, error)
+	TemplateData(installpath, rel string) (io.ReadCloser, os.FileInfo, error)
+	TemplateInstalled(installpath, basepath string, v WebotsVersion) (bool, error)
+	Drift(basepath string, v WebotsVersion) ([]TemplateDrift, error)
+	AddToProfile(name string, installpaths []string) error
+	RemoveFromProfile(name string, installpaths []string) error
+	EnableProfile(name string, enabled bool) error
+	Profiles() []TemplateProfile
+	FixDrift(basepath string, drifts []TemplateDrift) error
 }
 
 type Template struct {
 	Installpath, Datapath string
 	Whitelist, Blacklist  map[string]bool
+	// Rendered templates are text/template executed for each version,
+	// with user Variables, and installed as real files.
+	Rendered  bool              `json:",omitempty"`
+	Variables map[string]string `json:",omitempty"`
+	// Copied templates are installed as real files, for components
+	// not supporting symlinks or rewriting files in place.
+	Copied bool `json:",omitempty"`
+	// Copies are the hashes of the files written in each version, to
+	// only remove unmodified ones. They are keyed by copyKey.
+	Copies map[string]string `json:",omitempty"`
+	// Directory templates install every file of a snapshot of a tree,
+	// Created lists the directories they created in each version.
+	Directory bool                `json:",omitempty"`
+	Created   map[string][]string `json:",omitempty"`
+	// Stale are previous data paths of an updated template, which may
+	// still be installed in some versions.
+	Stale []string `json:",omitempty"`
+	// Override templates replace files shipped with webots. Backups
+	// are where the originals were moved, relative to the template
+	// data, keyed by copyKey.
+	Override bool              `json:",omitempty"`
+	Backups  map[string]string `json:",omitempty"`
+	// Patched templates are unified diffs applied to the shipped file,
+	// which is backed up like an overridden one. Patches is how the
+	// diff applied in each version.
+	Patched bool              `json:",omitempty"`
+	Patches map[string]string `json:",omitempty"`
+
+	// disabled is true if all profiles of the template are disabled
+	disabled bool
+}
+
+// copyKey identifies the copy of the file rel of a template in
+// version v. rel is empty for file templates.
+func copyKey(v WebotsVersion, rel string) string {
+	return path.Join(v.String(), rel)
+}
+
+// target returns where the file rel of the template is installed,
+// relative to a version.
+func (t Template) target(rel string) string {
+	return strings.TrimPrefix(path.Join("/", t.Installpath, rel), "/")
+}
+
+// TemplateContext is the data rendered templates are executed with
+type TemplateContext struct {
+	Version             string
+	Major, Minor, Patch uint
+	Home                string
+	Arch                string
+	Hostname            string
+	Vars                map[string]string
+}
+
+// Hash returns the sha256 of the content of the template, as used in
+// its data path.
+func (t Template) Hash() string {
+	prefix := fmt.Sprintf("%x", []byte(t.Installpath))
+	return strings.TrimPrefix(strings.TrimSuffix(t.Datapath, ".data"), prefix)
+}
+
+// copied returns true if the template is installed as a real file
+// instead of a link to its data.
+func (t Template) copied() bool {
+	return t.Rendered || t.Copied || t.Patched
+}
+
+// matchesRule returns true if v matches one of the version constraints
+// of rules.
+func matchesRule(rules map[string]bool, v WebotsVersion) bool {
+	for r := range rules {
+		c, err := ParseVersionConstraint(r)
+		if err == nil && c.Matches(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// AppliesTo returns true if the template should be installed in
+// version v, according to its white and black lists and profiles.
+func (t Template) AppliesTo(v WebotsVersion) bool {
+	if t.disabled {
+		return false
+	}
+	if matchesRule(t.Blacklist, v) {
+		return false
+	}
+	if len(t.Whitelist) != 0 && matchesRule(t.Whitelist, v) == false {
+		return false
+	}
+	return true
+}
+
+// normalizeRules rewrites rules in their normalized form. Exact
+// versions of older data.json are valid constraints, and are kept.
+func normalizeRules(installpath string, rules map[string]bool) (map[string]bool, error) {
+	res := make(map[string]bool)
+	for r := range rules {
+		c, err := ParseVersionConstraint(r)
+		if err != nil {
+			return nil, fmt.Errorf("Template %s has an invalid rule: %s", installpath, err)
+		}
+		res[c.String()] = true
+	}
+	return res, nil
 }
 
 type HashTemplateManager struct {
 	byPath   map[string]Template
+	profiles map[string]*TemplateProfile
 	basepath string
-	lock     lockfile.Lockfile
+	lock     *FileLock
 }
 
 func NewHasHTemplateManager(basepath string) (*HashTemplateManager, error) {
@@ -42,28 +175,48 @@ func NewHasHTemplateManager(basepath string) (*HashTemplateManager, error) {
 	if err != nil {
 		return nil, err
 	}
-	res.lock, err = lockfile.New(path.Join(basepath, "global.lock"))
+	res.lock, err = NewFileLock(path.Join(basepath, "global.lock"))
 	if err != nil {
 		return nil, err
 	}
 
-	if err := res.tryLock(); err != nil {
+	// taking the lock loads the templates
+	if err := res.tryRLock(); err != nil {
 		return nil, err
 	}
-	defer res.unlock()
+	res.unlock()
 
-	err = res.load()
-	if err != nil && err != io.EOF {
-		return nil, err
-	}
 	return res, nil
 
 }
 
 func (m *HashTemplateManager) tryLock() error {
-	if err := m.lock.TryLock(); err != nil {
-		return fmt.Errorf("COuld not lock %s: %s", m.lock, err)
+	if err := m.lock.Lock(); err != nil {
+		return err
+	}
+	return m.reload()
+}
+
+func (m *HashTemplateManager) tryRLock() error {
+	if err := m.lock.RLock(); err != nil {
+		return err
+	}
+	return m.reload()
+}
+
+// reload reads templates again, as they may have been modified while
+// we waited for the lock.
+func (m *HashTemplateManager) reload() error {
+	m.byPath = make(map[string]Template)
+	err := m.load()
+	if err == nil || err == io.EOF {
+		err = m.loadProfiles()
 	}
+	if err != nil && err != io.EOF {
+		m.unlock()
+		return err
+	}
+	m.updateDisabled()
 	return nil
 }
 
@@ -89,6 +242,15 @@ func (m *HashTemplateManager) load() error {
 		return err
 	}
 
+	for p, t := range m.byPath {
+		if t.Whitelist, err = normalizeRules(p, t.Whitelist); err != nil {
+			return err
+		}
+		if t.Blacklist, err = normalizeRules(p, t.Blacklist); err != nil {
+			return err
+		}
+		m.byPath[p] = t
+	}
 	return nil
 }
 
@@ -119,37 +281,284 @@ func (m *HashTemplateManager) RegisterTemplate(filepath, installpath string) err
 		return fmt.Errorf("Template to %s is already installed", installpath)
 	}
 
-	f, err := os.Open(filepath)
+	datapath, directory, err := m.storeData(filepath, installpath)
 	if err != nil {
 		return err
 	}
+
+	m.byPath[installpath] = Template{
+		Datapath:    datapath,
+		Installpath: installpath,
+		Blacklist:   make(map[string]bool),
+		Whitelist:   make(map[string]bool),
+		Directory:   directory,
+	}
+
+	return m.save()
+}
+
+// storeData stores the content of filepath, a file or a directory,
+// and returns its data path.
+func (m *HashTemplateManager) storeData(filepath, installpath string) (string, bool, error) {
+	fi, err := os.Stat(filepath)
+	if err != nil {
+		return "", false, err
+	}
+	if fi.IsDir() {
+		datapath, err := m.storeDirectory(filepath, installpath)
+		return datapath, true, err
+	}
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return "", false, err
+	}
 	defer f.Close()
 	var content bytes.Buffer
 	hash := sha256.New()
 	_, err = io.Copy(io.MultiWriter(&content, hash), f)
 	if err != nil {
-		return err
+		return "", false, err
 	}
 
 	filename := fmt.Sprintf("%x.data", hash.Sum([]byte(installpath)))
 
-	dest, err := os.Create(path.Join(m.basepath, filename))
-	_, err = io.Copy(dest, &content)
+	// keeps the mode, as copies are installed with it
+	err = writeUnshared(path.Join(m.basepath, filename), &content, fi.Mode().Perm())
+	if err != nil {
+		return "", false, err
+	}
+	return filename, false, nil
+}
+
+// listTree returns the files of a directory, relative to it. Only
+// regular files are supported.
+func listTree(root string) ([]string, error) {
+	var res []string
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if fi.Mode().IsRegular() == false {
+			return fmt.Errorf("Unsupported file %s in template directory, only regular files are supported", p)
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		res = append(res, rel)
+		return nil
+	})
+	sort.Strings(res)
+	return res, err
+}
+
+// storeDirectory stores a snapshot of the tree dir
+func (m *HashTemplateManager) storeDirectory(dir, installpath string) (string, error) {
+	files, err := listTree(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("Template directory %s is empty", dir)
+	}
+
+	tmp, err := ioutil.TempDir(m.basepath, ".snapshot-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	hash := sha256.New()
+	for _, rel := range files {
+		fi, err := os.Stat(path.Join(dir, rel))
+		if err != nil {
+			return "", err
+		}
+		f, err := os.Open(path.Join(dir, rel))
+		if err != nil {
+			return "", err
+		}
+		// the relative path is hashed too, so moving a file changes
+		// the snapshot
+		fmt.Fprintf(hash, "%s\x00", rel)
+		dest := path.Join(tmp, rel)
+		err = os.MkdirAll(path.Dir(dest), 0755)
+		if err == nil {
+			err = writeUnshared(dest, io.TeeReader(f, hash), fi.Mode().Perm())
+		}
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	dirname := fmt.Sprintf("%x.data", hash.Sum([]byte(installpath)))
+	if _, err := os.Stat(path.Join(m.basepath, dirname)); err == nil {
+		// same snapshot is already stored
+		return dirname, nil
+	}
+	if err := os.Rename(tmp, path.Join(m.basepath, dirname)); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(path.Join(m.basepath, dirname), 0755); err != nil {
+		return "", err
+	}
+	return dirname, nil
+}
+
+func stringIndex(l []string, s string) int {
+	for i, e := range l {
+		if e == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// UpdateTemplate replaces the content of a template, keeping its
+// rules. The previous content is kept as stale until CollectGarbage,
+// so installed files can still be recognized and replaced by
+// ApplyTemplates.
+func (m *HashTemplateManager) UpdateTemplate(filepath, installpath string) error {
+	if err := m.tryLock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+
+	t, ok := m.byPath[installpath]
+	if ok == false {
+		return fmt.Errorf("Unknown template %s", installpath)
+	}
+	fi, err := os.Stat(filepath)
 	if err != nil {
 		return err
 	}
+	if fi.IsDir() != t.Directory {
+		if t.Directory {
+			return fmt.Errorf("Template %s is a directory, %s is not", installpath, filepath)
+		}
+		return fmt.Errorf("Template %s is a file, %s is a directory", installpath, filepath)
+	}
 
-	m.byPath[installpath] = Template{
-		Datapath:    filename,
-		Installpath: installpath,
-		Blacklist:   make(map[string]bool),
-		Whitelist:   make(map[string]bool),
+	datapath, _, err := m.storeData(filepath, installpath)
+	if err != nil {
+		return err
+	}
+	if datapath == t.Datapath {
+		return nil
 	}
 
+	updated := t
+	updated.Datapath = datapath
+	if t.Rendered {
+		err = m.checkRender(updated, t.Variables)
+	} else if t.Patched {
+		err = m.checkPatch(updated)
+	}
+	// going back to a previous content reuses its stale data
+	wasStale := stringIndex(t.Stale, datapath) >= 0
+	if err != nil {
+		if wasStale == false {
+			os.RemoveAll(path.Join(m.basepath, datapath))
+		}
+		return err
+	}
+	updated.Stale = []string{t.Datapath}
+	for _, d := range t.Stale {
+		if d != datapath && d != t.Datapath {
+			updated.Stale = append(updated.Stale, d)
+		}
+	}
+	m.byPath[installpath] = updated
+	return m.save()
+}
+
+// CollectGarbage removes the previous content of updated templates.
+// It should only be called once templates are applied to all
+// versions.
+func (m *HashTemplateManager) CollectGarbage() error {
+	if err := m.tryLock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+
+	for p, t := range m.byPath {
+		if len(t.Stale) == 0 {
+			continue
+		}
+		for _, d := range t.Stale {
+			if d == t.Datapath {
+				continue
+			}
+			if err := os.RemoveAll(path.Join(m.basepath, d)); err != nil {
+				return err
+			}
+		}
+		t.Stale = nil
+		m.byPath[p] = t
+	}
 	return m.save()
 }
 
-func (m *HashTemplateManager) WhiteList(installpath string, vers []WebotsVersion) error {
+// files returns the files installed by template t, relative to its
+// install path. A file template installs a single file, named "".
+func (m *HashTemplateManager) files(t Template) ([]string, error) {
+	if t.Directory == false {
+		return []string{""}, nil
+	}
+	return listTree(path.Join(m.basepath, t.Datapath))
+}
+
+// staleFiles returns the files of the previous content of an updated
+// template which are no longer part of it.
+func (m *HashTemplateManager) staleFiles(t Template) ([]string, error) {
+	if t.Directory == false || len(t.Stale) == 0 {
+		return nil, nil
+	}
+	current, err := m.files(t)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	for _, rel := range current {
+		known[rel] = true
+	}
+	var res []string
+	for _, d := range t.Stale {
+		files, err := listTree(path.Join(m.basepath, d))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, rel := range files {
+			if known[rel] == false {
+				known[rel] = true
+				res = append(res, rel)
+			}
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// ownLink returns true if dest, the destination of an installed
+// symlink, is the current or a previous content of the file rel of t.
+func (m *HashTemplateManager) ownLink(t Template, rel, dest string) bool {
+	for _, d := range append([]string{t.Datapath}, t.Stale...) {
+		if dest == path.Join(m.basepath, d, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *HashTemplateManager) WhiteList(installpath string, rules []VersionConstraint) error {
 	if err := m.tryLock(); err != nil {
 		return err
 	}
@@ -159,13 +568,13 @@ func (m *HashTemplateManager) WhiteList(installpath string, vers []WebotsVersion
 	if ok == false {
 		return fmt.Errorf("Unknown template %s", installpath)
 	}
-	for _, v := range vers {
-		m.byPath[installpath].Whitelist[v.String()] = true
+	for _, r := range rules {
+		m.byPath[installpath].Whitelist[r.String()] = true
 	}
 
 	return m.save()
 }
-func (m *HashTemplateManager) BlackList(installpath string, vers []WebotsVersion) error {
+func (m *HashTemplateManager) BlackList(installpath string, rules []VersionConstraint) error {
 	if err := m.tryLock(); err != nil {
 		return err
 	}
@@ -175,47 +584,506 @@ func (m *HashTemplateManager) BlackList(installpath string, vers []WebotsVersion
 	if ok == false {
 		return fmt.Errorf("Unknown template %s", installpath)
 	}
-	for _, v := range vers {
-		m.byPath[installpath].Blacklist[v.String()] = true
+	for _, r := range rules {
+		m.byPath[installpath].Blacklist[r.String()] = true
 	}
 
 	return m.save()
 }
 
-func (m *HashTemplateManager) uninstallTemplate(basepath string, t Template) error {
-	absTarget := path.Join(basepath, t.Installpath)
+// Render makes a template rendered for each version with vars
+func (m *HashTemplateManager) Render(installpath string, vars map[string]string) error {
+	if err := m.tryLock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+
+	t, ok := m.byPath[installpath]
+	if ok == false {
+		return fmt.Errorf("Unknown template %s", installpath)
+	}
+	if err := m.checkRender(t, vars); err != nil {
+		return err
+	}
+	t.Rendered = true
+	t.Variables = vars
+	m.byPath[installpath] = t
+	return m.save()
+}
+
+// checkRender renders every file of t with a sample context, to catch
+// missing variables before applying to every version
+func (m *HashTemplateManager) checkRender(t Template, vars map[string]string) error {
+	files, err := m.files(t)
+	if err != nil {
+		return err
+	}
+	for _, rel := range files {
+		data, err := ioutil.ReadFile(path.Join(m.basepath, t.Datapath, rel))
+		if err != nil {
+			return err
+		}
+		tmpl, err := parseTemplate(t.target(rel), data)
+		if err != nil {
+			return err
+		}
+		sample := TemplateContext{Version: "0.0.0", Vars: vars}
+		if err := tmpl.Execute(ioutil.Discard, sample); err != nil {
+			return fmt.Errorf("Could not render template %s: %s", t.target(rel), err)
+		}
+	}
+	return nil
+}
+
+// Copy makes a template installed as a copy of its content instead of
+// a symlink
+func (m *HashTemplateManager) Copy(installpath string) error {
+	if err := m.tryLock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+
+	t, ok := m.byPath[installpath]
+	if ok == false {
+		return fmt.Errorf("Unknown template %s", installpath)
+	}
+	t.Copied = true
+	m.byPath[installpath] = t
+	return m.save()
+}
+
+// Override allows a template to replace existing files, which are
+// restored when it is removed
+func (m *HashTemplateManager) Override(installpath string) error {
+	if err := m.tryLock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+
+	t, ok := m.byPath[installpath]
+	if ok == false {
+		return fmt.Errorf("Unknown template %s", installpath)
+	}
+	t.Override = true
+	m.byPath[installpath] = t
+	return m.save()
+}
+
+// Patch makes a template a unified diff applied to the file installed
+// by webots
+func (m *HashTemplateManager) Patch(installpath string) error {
+	if err := m.tryLock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+
+	t, ok := m.byPath[installpath]
+	if ok == false {
+		return fmt.Errorf("Unknown template %s", installpath)
+	}
+	if t.Directory || t.Rendered || t.Copied {
+		return fmt.Errorf("Template %s cannot be a patch, only a single file can be", installpath)
+	}
+	if err := m.checkPatch(t); err != nil {
+		return err
+	}
+	t.Patched = true
+	m.byPath[installpath] = t
+	return m.save()
+}
+
+func (m *HashTemplateManager) checkPatch(t Template) error {
+	data, err := ioutil.ReadFile(path.Join(m.basepath, t.Datapath))
+	if err != nil {
+		return err
+	}
+	if _, err := parsePatch(data); err != nil {
+		return fmt.Errorf("Invalid patch for %s: %s", t.Installpath, err)
+	}
+	return nil
+}
+
+func parseTemplate(name string, data []byte) (*template.Template, error) {
+	res, err := template.New(name).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid template %s: %s", name, err)
+	}
+	return res, nil
+}
+
+// content returns what the file rel of template t installs in version
+// v
+func (m *HashTemplateManager) content(basepath string, v WebotsVersion, t Template, rel string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path.Join(m.basepath, t.Datapath, rel))
+	if err != nil || t.Rendered == false {
+		return data, err
+	}
+
+	tmpl, err := parseTemplate(t.target(rel), data)
+	if err != nil {
+		return nil, err
+	}
+	ctx := TemplateContext{
+		Version:  v.String(),
+		Major:    v.Major,
+		Minor:    v.Minor,
+		Patch:    v.Patch,
+		Home:     basepath,
+		Vars:     t.Variables,
+		Hostname: "localhost",
+	}
+	if ctx.Arch, err = webotsArch(); err != nil {
+		return nil, err
+	}
+	if h, err := os.Hostname(); err == nil {
+		ctx.Hostname = h
+	}
+	var res bytes.Buffer
+	if err := tmpl.Execute(&res, ctx); err != nil {
+		return nil, fmt.Errorf("Could not render template %s for %s: %s", t.target(rel), v, err)
+	}
+	return res.Bytes(), nil
+}
+
+// installedCopy returns the hash of the file absTarget, and if it is
+// the copy we installed, whose hash is recorded.
+func installedCopy(absTarget, recorded string) (string, bool, error) {
+	fi, err := os.Lstat(absTarget)
+	if err != nil {
+		return "", false, err
+	}
+	if fi.Mode().IsRegular() == false {
+		return "", false, nil
+	}
+	h, err := hashFile(absTarget)
+	if err != nil {
+		return "", false, err
+	}
+	return h, h == recorded, nil
+}
+
+func (m *HashTemplateManager) uninstallTemplate(basepath string, v WebotsVersion, t Template) error {
+	files, err := m.files(t)
+	if err != nil {
+		return err
+	}
+	stale, err := m.staleFiles(t)
+	if err != nil {
+		return err
+	}
+	for _, rel := range append(files, stale...) {
+		if err := m.uninstallFile(basepath, v, t, rel); err != nil {
+			return err
+		}
+	}
+
+	// removes created directories, deepest first, unless something
+	// else was put in them
+	created := t.Created[v.String()]
+	for i := len(created) - 1; i >= 0; i-- {
+		os.Remove(path.Join(basepath, created[i]))
+	}
+	delete(t.Created, v.String())
+	delete(t.Patches, v.String())
+	return nil
+}
+
+func (m *HashTemplateManager) uninstallFile(basepath string, v WebotsVersion, t Template, rel string) error {
+	if err := m.removeFile(basepath, v, t, rel); err != nil {
+		return err
+	}
+	return m.restoreBackup(basepath, v, t, rel)
+}
+
+// backup moves aside the existing file overridden by the file rel of
+// t in version v
+func (m *HashTemplateManager) backup(basepath string, v WebotsVersion, t Template, rel string) error {
+	absTarget := path.Join(basepath, t.target(rel))
+	if t.Override == false && t.Patched == false {
+		return fmt.Errorf("File %s already exists, add the template with --override to replace it", absTarget)
+	}
+	if _, ok := t.Backups[copyKey(v, rel)]; ok == true {
+		return fmt.Errorf("File %s already exists", absTarget)
+	}
+	if fi, err := os.Lstat(absTarget); err != nil {
+		return err
+	} else if fi.IsDir() {
+		return fmt.Errorf("Cannot override directory %s", absTarget)
+	}
+	backup := path.Join("backups", v.String(), t.target(rel))
+	if err := os.MkdirAll(path.Dir(path.Join(m.basepath, backup)), 0775); err != nil {
+		return err
+	}
+	if err := os.Rename(absTarget, path.Join(m.basepath, backup)); err != nil {
+		return err
+	}
+	t.Backups[copyKey(v, rel)] = backup
+	return nil
+}
+
+// restoreBackup puts back the file overridden by the file rel of t in
+// version v, if any
+func (m *HashTemplateManager) restoreBackup(basepath string, v WebotsVersion, t Template, rel string) error {
+	backup, ok := t.Backups[copyKey(v, rel)]
+	if ok == false {
+		return nil
+	}
+	absTarget := path.Join(basepath, t.target(rel))
+	if _, err := os.Lstat(absTarget); err == nil {
+		return fmt.Errorf("Cannot restore original %s, it was replaced", absTarget)
+	}
+	if err := os.Rename(path.Join(m.basepath, backup), absTarget); err != nil {
+		return err
+	}
+	delete(t.Backups, copyKey(v, rel))
+	return nil
+}
+
+func (m *HashTemplateManager) removeFile(basepath string, v WebotsVersion, t Template, rel string) error {
+	absTarget := path.Join(basepath, t.target(rel))
 	_, err := os.Lstat(absTarget)
 	if os.IsNotExist(err) {
+		if t.copied() {
+			delete(t.Copies, copyKey(v, rel))
+		}
 		return nil
 	}
 	if err != nil {
 		return err
 	}
 
+	if t.copied() {
+		recorded, ok := t.Copies[copyKey(v, rel)]
+		if ok == false {
+			return nil
+		}
+		_, ours, err := installedCopy(absTarget, recorded)
+		if err != nil {
+			return err
+		}
+		if ours == false {
+			return fmt.Errorf("%s was modified since installed by template, not removing it", absTarget)
+		}
+		delete(t.Copies, copyKey(v, rel))
+		return os.Remove(absTarget)
+	}
+
 	//check that it is a target
 	dataTarget, err := os.Readlink(absTarget)
 	if err != nil {
-		return err
+		// not a link, the template was not installed over it
+		return nil
 	}
-	if dataTarget != path.Join(m.basepath, t.Datapath) {
+	if m.ownLink(t, rel, dataTarget) == false {
 		return fmt.Errorf("Synlink %s installed is not a template (points to %s )", absTarget, dataTarget)
 	}
 
 	return os.Remove(absTarget)
 }
 
-func (m *HashTemplateManager) installTemplate(basepath string, t Template) error {
-	absTarget := path.Join(basepath, t.Installpath)
+func (m *HashTemplateManager) installTemplate(basepath string, v WebotsVersion, t Template) error {
+	files, err := m.files(t)
+	if err != nil {
+		return err
+	}
+	for _, rel := range files {
+		if t.Directory {
+			if err := makeParents(basepath, v, t, t.target(rel)); err != nil {
+				return err
+			}
+		}
+		if err := m.installFile(basepath, v, t, rel); err != nil {
+			return err
+		}
+	}
+
+	// files dropped by an update, and the directories they leave empty
+	stale, err := m.staleFiles(t)
+	if err != nil || len(stale) == 0 {
+		return err
+	}
+	for _, rel := range stale {
+		if err := m.uninstallFile(basepath, v, t, rel); err != nil {
+			return err
+		}
+	}
+	created := append([]string(nil), t.Created[v.String()]...)
+	for i := len(created) - 1; i >= 0; i-- {
+		if os.Remove(path.Join(basepath, created[i])) == nil {
+			created = append(created[:i], created[i+1:]...)
+		}
+	}
+	t.Created[v.String()] = created
+	return nil
+}
+
+// makeParents creates the missing parents of target in a version, and
+// records them in the template.
+func makeParents(basepath string, v WebotsVersion, t Template, target string) error {
+	var missing []string
+	for d := path.Dir(target); d != "." && d != "/"; d = path.Dir(d) {
+		_, err := os.Lstat(path.Join(basepath, d))
+		if err == nil {
+			break
+		}
+		if os.IsNotExist(err) == false {
+			return err
+		}
+		missing = append(missing, d)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(path.Join(basepath, missing[i]), 0775); err != nil {
+			return err
+		}
+		t.Created[v.String()] = append(t.Created[v.String()], missing[i])
+	}
+	return nil
+}
+
+func (m *HashTemplateManager) installFile(basepath string, v WebotsVersion, t Template, rel string) error {
+	absTarget := path.Join(basepath, t.target(rel))
+	dataPath := path.Join(m.basepath, t.Datapath, rel)
 	_, err := os.Lstat(absTarget)
 	if err != nil && os.IsNotExist(err) == false {
 		return err
 	}
-	if err == nil {
-		return fmt.Errorf("File %s already exists", absTarget)
+	exists := err == nil
+
+	if t.Patched {
+		return m.installPatch(basepath, v, t, absTarget)
+	}
+
+	if t.copied() {
+		content, err := m.content(basepath, v, t, rel)
+		if err != nil {
+			return err
+		}
+		hash := fmt.Sprintf("%x", sha256.Sum256(content))
+		if exists {
+			current, ours, err := installedCopy(absTarget, t.Copies[copyKey(v, rel)])
+			if err != nil {
+				return err
+			}
+			if _, recorded := t.Copies[copyKey(v, rel)]; ours == false && recorded {
+				// rewritten in place, e.g. by webots itself
+				log.Printf("%s was modified, left untouched", absTarget)
+				return nil
+			} else if ours == false {
+				if err := m.backup(basepath, v, t, rel); err != nil {
+					return err
+				}
+			} else if current == hash {
+				return nil
+			}
+		}
+		fi, err := os.Stat(dataPath)
+		if err != nil {
+			return err
+		}
+		// the file may be hardlinked by dedup
+		if err := writeUnshared(absTarget, bytes.NewReader(content), fi.Mode().Perm()); err != nil {
+			return err
+		}
+		t.Copies[copyKey(v, rel)] = hash
+		return copyOwnership(fi, absTarget)
 	}
 
-	return os.Symlink(path.Join(m.basepath, t.Datapath), absTarget)
+	if exists {
+		dest, err := os.Readlink(absTarget)
+		if err != nil || m.ownLink(t, rel, dest) == false {
+			if err := m.backup(basepath, v, t, rel); err != nil {
+				return err
+			}
+		} else if dest == dataPath {
+			return nil
+		} else if err := os.Remove(absTarget); err != nil {
+			// previous content of an updated template
+			return err
+		}
+	}
 
+	return os.Symlink(dataPath, absTarget)
+}
+
+// installPatch applies the patch t to the file absTarget of version v,
+// or to its original if it is already patched. A patch that does not
+// apply is reverted, and reported without failing.
+func (m *HashTemplateManager) installPatch(basepath string, v WebotsVersion, t Template, absTarget string) error {
+	key := copyKey(v, "")
+	original := absTarget
+	backup, patched := t.Backups[key]
+	if patched {
+		original = path.Join(m.basepath, backup)
+	}
+
+	status := PatchClean
+	content, notes, err := m.patchedContent(t, original)
+	if err == nil && len(notes) != 0 {
+		status = PatchFuzz
+	}
+	if err != nil {
+		status = PatchFailed
+		if t.Patches[v.String()] != PatchFailed {
+			log.Printf("Could not patch %s in %s: %s", t.Installpath, v, err)
+		}
+	}
+	t.Patches[v.String()] = status
+	if err != nil {
+		if patched {
+			return m.uninstallFile(basepath, v, t, "")
+		}
+		return nil
+	}
+
+	hash := fmt.Sprintf("%x", sha256.Sum256(content))
+	if patched {
+		current, ours, err := installedCopy(absTarget, t.Copies[key])
+		if err != nil && os.IsNotExist(err) == false {
+			return err
+		}
+		if err == nil && ours == false {
+			return fmt.Errorf("%s was modified since patched by template, not patching it again", absTarget)
+		}
+		if current == hash {
+			return nil
+		}
+	} else if err := m.backup(basepath, v, t, ""); err != nil {
+		return err
+	}
+
+	if status == PatchFuzz {
+		log.Printf("Patched %s in %s with fuzz: %s", t.Installpath, v, strings.Join(notes, ", "))
+	}
+	fi, err := os.Stat(path.Join(m.basepath, t.Backups[key]))
+	if err != nil {
+		return err
+	}
+	// the file may be hardlinked by dedup
+	if err := writeUnshared(absTarget, bytes.NewReader(content), fi.Mode().Perm()); err != nil {
+		return err
+	}
+	t.Copies[key] = hash
+	return copyOwnership(fi, absTarget)
+}
+
+// patchedContent returns the content of original patched by t
+func (m *HashTemplateManager) patchedContent(t Template, original string) ([]byte, []string, error) {
+	content, err := ioutil.ReadFile(original)
+	if os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("%s does not exist", t.Installpath)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	diff, err := ioutil.ReadFile(path.Join(m.basepath, t.Datapath))
+	if err != nil {
+		return nil, nil, err
+	}
+	hunks, err := parsePatch(diff)
+	if err != nil {
+		return nil, nil, err
+	}
+	return applyPatch(content, hunks)
 }
 
 func (m *HashTemplateManager) ApplyTemplates(basepath string, v WebotsVersion) error {
@@ -224,31 +1092,37 @@ func (m *HashTemplateManager) ApplyTemplates(basepath string, v WebotsVersion) e
 	}
 	defer m.unlock()
 
-	//check if blacklisted
-	for _, t := range m.byPath {
-		//if blacklisted
-		shouldRemove := false
-		if _, ok := t.Blacklist[v.String()]; ok == true {
-			shouldRemove = true
-		}
-		if len(t.Whitelist) != 0 {
-			if _, ok := t.Whitelist[v.String()]; ok == false {
-				shouldRemove = true
-			}
+	var err error
+	for p, t := range m.byPath {
+		if t.Copies == nil {
+			t.Copies = make(map[string]string)
 		}
-
-		if shouldRemove {
-			if err := m.uninstallTemplate(basepath, t); err != nil {
-				return err
-			}
+		if t.Created == nil {
+			t.Created = make(map[string][]string)
+		}
+		if t.Backups == nil {
+			t.Backups = make(map[string]string)
+		}
+		if t.Patches == nil {
+			t.Patches = make(map[string]string)
+		}
+		m.byPath[p] = t
+		if t.AppliesTo(v) == false {
+			err = m.uninstallTemplate(basepath, v, t)
 		} else {
-			if err := m.installTemplate(basepath, t); err != nil {
-				return err
-			}
+			err = m.installTemplate(basepath, v, t)
+		}
+		if err != nil {
+			break
 		}
 	}
 
-	return nil
+	// hashes of copies and created directories are kept even on
+	// failure
+	if serr := m.save(); err == nil {
+		err = serr
+	}
+	return err
 }
 
 func (m *HashTemplateManager) RemoveTemplate(installpath string) error {
@@ -262,11 +1136,193 @@ func (m *HashTemplateManager) RemoveTemplate(installpath string) error {
 		return fmt.Errorf("Id %s not found", installpath)
 	}
 
-	err := os.Remove(path.Join(m.basepath, t.Datapath))
-	if err != nil {
-		return err
+	for _, d := range append([]string{t.Datapath}, t.Stale...) {
+		if err := os.RemoveAll(path.Join(m.basepath, d)); err != nil {
+			return err
+		}
 	}
 	//we still conserve that we should remove these links
 	delete(m.byPath, installpath)
+	if err := m.forgetProfiles(installpath); err != nil {
+		return err
+	}
 	return m.save()
 }
+
+// Templates returns all registered templates, by install path
+func (m *HashTemplateManager) Templates() []Template {
+	res := make([]Template, 0, len(m.byPath))
+	for _, t := range m.byPath {
+		res = append(res, t)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Installpath < res[j].Installpath })
+	return res
+}
+
+func (m *HashTemplateManager) TemplatesFor(v WebotsVersion) []Template {
+	var res []Template
+	for _, t := range m.byPath {
+		if t.AppliesTo(v) {
+			res = append(res, t)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Installpath < res[j].Installpath })
+	return res
+}
+
+// TemplateFiles returns the files installed by a template, relative
+// to its install path. A file template has a single file named "".
+func (m *HashTemplateManager) TemplateFiles(installpath string) ([]string, error) {
+	if err := m.tryRLock(); err != nil {
+		return nil, err
+	}
+	defer m.unlock()
+
+	t, ok := m.byPath[installpath]
+	if ok == false {
+		return nil, fmt.Errorf("Unknown template %s", installpath)
+	}
+	return m.files(t)
+}
+
+func (m *HashTemplateManager) TemplateData(installpath, rel string) (io.ReadCloser, os.FileInfo, error) {
+	if err := m.tryRLock(); err != nil {
+		return nil, nil, err
+	}
+	defer m.unlock()
+
+	t, ok := m.byPath[installpath]
+	if ok == false {
+		return nil, nil, fmt.Errorf("Unknown template %s", installpath)
+	}
+	f, err := os.Open(path.Join(m.basepath, t.Datapath, rel))
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, fi, nil
+}
+
+// TrackedFiles returns the install paths of all templates, relative to
+// a version. Templates replace or remove what is there, whatever the
+// version they apply to.
+func (m *HashTemplateManager) TrackedFiles() (map[string]bool, error) {
+	if err := m.tryRLock(); err != nil {
+		return nil, err
+	}
+	defer m.unlock()
+
+	res := make(map[string]bool)
+	for installpath := range m.byPath {
+		res[strings.TrimPrefix(path.Join("/", installpath), "/")] = true
+	}
+	return res, nil
+}
+
+// copyOwnership gives dest the owner and group of fi, when we are
+// allowed to.
+func copyOwnership(fi os.FileInfo, dest string) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if ok == false {
+		return nil
+	}
+	err := os.Lchown(dest, int(st.Uid), int(st.Gid))
+	if err != nil && os.IsPermission(err) == false {
+		return err
+	}
+	return nil
+}
+
+// TemplateInstalled returns true if every file of a template is
+// installed in the version v, at basepath.
+func (m *HashTemplateManager) TemplateInstalled(installpath, basepath string, v WebotsVersion) (bool, error) {
+	if err := m.tryRLock(); err != nil {
+		return false, err
+	}
+	defer m.unlock()
+
+	t, ok := m.byPath[installpath]
+	if ok == false {
+		return false, fmt.Errorf("Unknown template %s", installpath)
+	}
+	files, err := m.files(t)
+	if err != nil {
+		return false, err
+	}
+	for _, rel := range files {
+		absTarget := path.Join(basepath, t.target(rel))
+		var ours bool
+		if t.copied() {
+			recorded, recordedOk := t.Copies[copyKey(v, rel)]
+			_, ours, err = installedCopy(absTarget, recorded)
+			ours = ours && recordedOk
+		} else {
+			var dest string
+			dest, err = os.Readlink(absTarget)
+			ours = err == nil && dest == path.Join(m.basepath, t.Datapath, rel)
+			if err != nil {
+				// not a link
+				_, err = os.Lstat(absTarget)
+			}
+		}
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if ours == false {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ForgetVersion forgets what templates installed in the removed
+// version v, and the original files they overrode.
+func (m *HashTemplateManager) ForgetVersion(v WebotsVersion) error {
+	if err := m.tryLock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+
+	for p, t := range m.byPath {
+		for _, records := range []map[string]string{t.Copies, t.Backups} {
+			for key := range records {
+				if key == v.String() || strings.HasPrefix(key, v.String()+"/") {
+					delete(records, key)
+				}
+			}
+		}
+		delete(t.Created, v.String())
+		delete(t.Patches, v.String())
+		m.byPath[p] = t
+	}
+	if err := os.RemoveAll(path.Join(m.basepath, "backups", v.String())); err != nil {
+		return err
+	}
+	return m.save()
+}
+
+// TemplateBackup returns the original file overridden by the file rel
+// of a template in version v, if any.
+func (m *HashTemplateManager) TemplateBackup(installpath string, v WebotsVersion, rel string) (string, bool, error) {
+	if err := m.tryRLock(); err != nil {
+		return "", false, err
+	}
+	defer m.unlock()
+
+	t, ok := m.byPath[installpath]
+	if ok == false {
+		return "", false, fmt.Errorf("Unknown template %s", installpath)
+	}
+	backup, ok := t.Backups[copyKey(v, rel)]
+	if ok == false {
+		return "", false, nil
+	}
+	return path.Join(m.basepath, backup), true, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestUpdateTemplateStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webots-manager-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m, err := NewHasHTemplateManager(path.Join(dir, "templates"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := path.Join(dir, "source.ini")
+	datapaths := make(map[string]string)
+	for i, content := range []string{"a", "b", "a", "c", "b"} {
+		if err := ioutil.WriteFile(source, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			err = m.RegisterTemplate(source, "conf/source.ini")
+		} else {
+			err = m.UpdateTemplate(source, "conf/source.ini")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		datapaths[content] = m.byPath["conf/source.ini"].Datapath
+	}
+
+	tmpl := m.byPath["conf/source.ini"]
+	expected := []string{datapaths["c"], datapaths["a"]}
+	if reflect.DeepEqual(tmpl.Stale, expected) == false {
+		t.Errorf("Expected stale %v, got %v", expected, tmpl.Stale)
+	}
+
+	if err := m.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(m.basepath, tmpl.Datapath)); err != nil {
+		t.Errorf("Current data was collected: %s", err)
+	}
+	for _, content := range []string{"a", "c"} {
+		if _, err := os.Stat(path.Join(m.basepath, datapaths[content])); os.IsNotExist(err) == false {
+			t.Errorf("Stale data %s was not collected", content)
+		}
+	}
+}
+
+func TestRemoveTemplateRemovesStaleData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webots-manager-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m, err := NewHasHTemplateManager(path.Join(dir, "templates"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := path.Join(dir, "source.ini")
+	if err := ioutil.WriteFile(source, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RegisterTemplate(source, "conf/source.ini"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(source, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.UpdateTemplate(source, "conf/source.ini"); err != nil {
+		t.Fatal(err)
+	}
+	tmpl := m.byPath["conf/source.ini"]
+
+	if err := m.RemoveTemplate("conf/source.ini"); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range append([]string{tmpl.Datapath}, tmpl.Stale...) {
+		if _, err := os.Stat(path.Join(m.basepath, d)); os.IsNotExist(err) == false {
+			t.Errorf("Data %s of the removed template is still there", d)
+		}
+	}
+}
+
+func TestCopyModifiedInPlace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webots-manager-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m, err := NewHasHTemplateManager(path.Join(dir, "templates"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := ParseWebotsVersion("8.5.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := path.Join(dir, v.String())
+	if err := os.MkdirAll(path.Join(root, "conf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, installpath := range []string{"conf/a.ini", "conf/b.ini"} {
+		source := path.Join(dir, path.Base(installpath))
+		if err := ioutil.WriteFile(source, []byte("template"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.RegisterTemplate(source, installpath); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Copy(installpath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.ApplyTemplates(root, v); err != nil {
+		t.Fatal(err)
+	}
+
+	// webots rewrites its config in place, and one copy was removed
+	if err := ioutil.WriteFile(path.Join(root, "conf/a.ini"), []byte("rewritten"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(root, "conf/b.ini")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ApplyTemplates(root, v); err != nil {
+		t.Fatalf("Modified copy should be left untouched, got %s", err)
+	}
+	expected := map[string]string{
+		"conf/a.ini": "rewritten",
+		"conf/b.ini": "template",
+	}
+	for rel, content := range expected {
+		data, err := ioutil.ReadFile(path.Join(root, rel))
+		if err != nil {
+			t.Errorf("Could not read %s: %s", rel, err)
+		} else if string(data) != content {
+			t.Errorf("Expected %q in %s, got %q", content, rel, data)
+		}
+	}
+
+	// files the store does not track are never replaced
+	other := path.Join(dir, "8.6.0")
+	if err := os.MkdirAll(path.Join(other, "conf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(other, "conf/a.ini"), []byte("shipped"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	v, err = ParseWebotsVersion("8.6.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ApplyTemplates(other, v); err == nil {
+		t.Errorf("Untracked file should not be replaced")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"path"
+	"sort"
+)
+
+// TemplatePresence tells, for an installed version, if a template
+// should be installed according to its rules, and if it actually is.
+type TemplatePresence struct {
+	Version  string
+	Expected bool
+	Present  bool
+	// Patch is how a patch template applied, if it is one
+	Patch string `json:",omitempty"`
+}
+
+// TemplateListing describes a registered template
+type TemplateListing struct {
+	Installpath string
+	Hash        string
+	Size        int64
+	Files       int
+	Directory   bool
+	Copied      bool
+	Rendered    bool
+	Override    bool
+	Patched     bool
+	Whitelist   []string
+	Blacklist   []string
+	Profiles    []string
+	// Disabled is true if all profiles of the template are disabled
+	Disabled bool
+	Versions []TemplatePresence
+}
+
+func sortedKeys(m map[string]bool) []string {
+	res := []string{}
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// ListTemplates describes all registered templates, and their presence
+// in each installed version.
+func (m *SymlinkWebotsManager) ListTemplates() ([]TemplateListing, error) {
+	if err := m.tryRLock(); err != nil {
+		return nil, err
+	}
+	defer m.unlock()
+
+	profiles := make(map[string][]string)
+	for _, p := range m.templates.Profiles() {
+		for _, installpath := range p.Templates {
+			profiles[installpath] = append(profiles[installpath], p.Name)
+		}
+	}
+
+	var res []TemplateListing
+	for _, t := range m.templates.Templates() {
+		l := TemplateListing{
+			Installpath: t.Installpath,
+			Hash:        t.Hash(),
+			Directory:   t.Directory,
+			Copied:      t.Copied,
+			Rendered:    t.Rendered,
+			Override:    t.Override,
+			Patched:     t.Patched,
+			Whitelist:   sortedKeys(t.Whitelist),
+			Blacklist:   sortedKeys(t.Blacklist),
+			Profiles:    append([]string{}, profiles[t.Installpath]...),
+			Disabled:    t.disabled,
+			Versions:    []TemplatePresence{},
+		}
+		files, err := m.templates.TemplateFiles(t.Installpath)
+		if err != nil {
+			return nil, err
+		}
+		for _, rel := range files {
+			r, fi, err := m.templates.TemplateData(t.Installpath, rel)
+			if err != nil {
+				return nil, err
+			}
+			r.Close()
+			l.Size += fi.Size()
+		}
+		l.Files = len(files)
+
+		for _, v := range m.installed {
+			present, err := m.templates.TemplateInstalled(t.Installpath, path.Join(m.workpath, v.String()), v)
+			if err != nil {
+				return nil, err
+			}
+			l.Versions = append(l.Versions, TemplatePresence{
+				Version:  v.String(),
+				Expected: t.AppliesTo(v),
+				Present:  present,
+				Patch:    t.Patches[v.String()],
+			})
+		}
+		res = append(res, l)
+	}
+	return res, nil
+}
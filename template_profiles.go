@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+)
+
+// Profiles are named sets of templates, stored in profiles.json next
+// to data.json. A template belonging to profiles is only applied if
+// one of them is enabled, templates without profile are always
+// applied.
+
+type TemplateProfile struct {
+	Name      string
+	Enabled   bool
+	Templates []string
+}
+
+func (m *HashTemplateManager) loadProfiles() error {
+	m.profiles = make(map[string]*TemplateProfile)
+	f, err := os.Open(path.Join(m.basepath, "profiles.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewDecoder(f).Decode(&m.profiles)
+}
+
+func (m *HashTemplateManager) saveProfiles() error {
+	f, err := os.Create(path.Join(m.basepath, "profiles.json"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(&m.profiles)
+}
+
+// updateDisabled marks templates whose profiles are all disabled
+func (m *HashTemplateManager) updateDisabled() {
+	enabled := make(map[string]bool)
+	for _, p := range m.profiles {
+		for _, installpath := range p.Templates {
+			enabled[installpath] = enabled[installpath] || p.Enabled
+		}
+	}
+	for installpath, t := range m.byPath {
+		e, inProfile := enabled[installpath]
+		t.disabled = inProfile && e == false
+		m.byPath[installpath] = t
+	}
+}
+
+// AddToProfile adds templates to the profile name, created enabled if
+// needed
+func (m *HashTemplateManager) AddToProfile(name string, installpaths []string) error {
+	if err := m.tryLock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+
+	p, ok := m.profiles[name]
+	if ok == false {
+		p = &TemplateProfile{Name: name, Enabled: true}
+		m.profiles[name] = p
+	}
+	for _, installpath := range installpaths {
+		if _, ok := m.byPath[installpath]; ok == false {
+			return fmt.Errorf("Unknown template %s", installpath)
+		}
+		if stringIndex(p.Templates, installpath) < 0 {
+			p.Templates = append(p.Templates, installpath)
+		}
+	}
+	sort.Strings(p.Templates)
+	return m.saveProfiles()
+}
+
+// RemoveFromProfile removes templates from the profile name, which is
+// deleted once empty
+func (m *HashTemplateManager) RemoveFromProfile(name string, installpaths []string) error {
+	if err := m.tryLock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+
+	p, ok := m.profiles[name]
+	if ok == false {
+		return fmt.Errorf("Unknown profile %s", name)
+	}
+	for _, installpath := range installpaths {
+		i := stringIndex(p.Templates, installpath)
+		if i < 0 {
+			return fmt.Errorf("Template %s is not in profile %s", installpath, name)
+		}
+		p.Templates = append(p.Templates[:i], p.Templates[i+1:]...)
+	}
+	if len(p.Templates) == 0 {
+		delete(m.profiles, name)
+	}
+	return m.saveProfiles()
+}
+
+// EnableProfile enables or disables the templates of profile name. It
+// does not apply them.
+func (m *HashTemplateManager) EnableProfile(name string, enabled bool) error {
+	if err := m.tryLock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+
+	p, ok := m.profiles[name]
+	if ok == false {
+		return fmt.Errorf("Unknown profile %s", name)
+	}
+	p.Enabled = enabled
+	return m.saveProfiles()
+}
+
+// Profiles returns all profiles, sorted by name
+func (m *HashTemplateManager) Profiles() []TemplateProfile {
+	res := make([]TemplateProfile, 0, len(m.profiles))
+	for _, p := range m.profiles {
+		res = append(res, *p)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// forgetProfiles removes a removed template from all profiles
+func (m *HashTemplateManager) forgetProfiles(installpath string) error {
+	changed := false
+	for name, p := range m.profiles {
+		if i := stringIndex(p.Templates, installpath); i >= 0 {
+			p.Templates = append(p.Templates[:i], p.Templates[i+1:]...)
+			changed = true
+		}
+		if len(p.Templates) == 0 {
+			delete(m.profiles, name)
+		}
+	}
+	if changed == false {
+		return nil
+	}
+	return m.saveProfiles()
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Drift is the difference between what templates should install in a
+// version, and what its tree actually contains.
+
+const (
+	// DriftMissing is a template file which should be installed
+	DriftMissing = "missing"
+	// DriftExtraneous is a template file which should not be installed
+	DriftExtraneous = "extraneous"
+	// DriftForeign is a file in place of a template file, not
+	// installed by it
+	DriftForeign = "foreign"
+	// DriftModified is a template file modified since installed, or a
+	// link to a previous content of the template
+	DriftModified = "modified"
+)
+
+type TemplateDrift struct {
+	Template string
+	// Path is relative to the version
+	Path   string
+	Kind   string
+	Detail string
+	// how FixDrift makes room for applying templates again: links
+	// are removed, real files saved aside
+	remove, save bool
+}
+
+// VersionDrift is the drift of an installed version. Remaining is what
+// could not be fixed.
+type VersionDrift struct {
+	Version   WebotsVersion
+	Drifts    []TemplateDrift
+	Remaining []TemplateDrift
+}
+
+// expected returns true if the file of t should be installed in v
+func (t Template) expected(v WebotsVersion) bool {
+	return t.AppliesTo(v) && (t.Patched == false || t.Patches[v.String()] != PatchFailed)
+}
+
+// Drift compares the files templates should install in version v,
+// at basepath, with what is installed.
+func (m *HashTemplateManager) Drift(basepath string, v WebotsVersion) ([]TemplateDrift, error) {
+	if err := m.tryRLock(); err != nil {
+		return nil, err
+	}
+	defer m.unlock()
+
+	var res []TemplateDrift
+	known := make(map[string]bool)
+	for _, t := range m.Templates() {
+		files, err := m.files(t)
+		if err != nil {
+			return nil, err
+		}
+		stale, err := m.staleFiles(t)
+		if err != nil {
+			return nil, err
+		}
+		for _, rel := range files {
+			known[t.target(rel)] = true
+			d, err := m.fileDrift(basepath, v, t, rel, t.expected(v))
+			if err != nil {
+				return nil, err
+			}
+			if d != nil {
+				res = append(res, *d)
+			}
+		}
+		for _, rel := range stale {
+			known[t.target(rel)] = true
+			d, err := m.fileDrift(basepath, v, t, rel, false)
+			if err != nil {
+				return nil, err
+			}
+			if d != nil {
+				res = append(res, *d)
+			}
+		}
+	}
+
+	// links to the data of removed templates
+	err := filepath.Walk(basepath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			return err
+		}
+		rel, err := filepath.Rel(basepath, p)
+		if err != nil || known[rel] {
+			return err
+		}
+		dest, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(dest, m.basepath+"/") {
+			res = append(res, TemplateDrift{
+				Path:   rel,
+				Kind:   DriftExtraneous,
+				Detail: fmt.Sprintf("link to %s, which is not a template", dest),
+				remove: true,
+			})
+		}
+		return nil
+	})
+	return res, err
+}
+
+// fileDrift returns the drift of the file rel of t, or nil
+func (m *HashTemplateManager) fileDrift(basepath string, v WebotsVersion, t Template, rel string, expected bool) (*TemplateDrift, error) {
+	target := t.target(rel)
+	absTarget := path.Join(basepath, target)
+	var fi os.FileInfo
+	drift := func(kind, format string, args ...interface{}) (*TemplateDrift, error) {
+		return &TemplateDrift{
+			Template: t.Installpath,
+			Path:     target,
+			Kind:     kind,
+			Detail:   fmt.Sprintf(format, args...),
+		}, nil
+	}
+	// a file replacing or modifying what the template installed is
+	// moved aside, so that it is installed again
+	inTheWay := func(kind, format string, args ...interface{}) (*TemplateDrift, error) {
+		d, _ := drift(kind, format, args...)
+		d.remove = fi.Mode()&os.ModeSymlink != 0
+		d.save = fi.Mode().IsRegular()
+		return d, nil
+	}
+	// a file the template never installed is only reported: it is
+	// left alone, unless the template overrides it and applying it
+	// backs the file up
+	_, backedUp := t.Backups[copyKey(v, rel)]
+	foreign := func(format string, args ...interface{}) (*TemplateDrift, error) {
+		if backedUp {
+			return inTheWay(DriftForeign, format, args...)
+		}
+		return drift(DriftForeign, format, args...)
+	}
+
+	fi, err := os.Lstat(absTarget)
+	if os.IsNotExist(err) {
+		if expected {
+			return drift(DriftMissing, "not installed")
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if t.copied() {
+		recorded, ok := t.Copies[copyKey(v, rel)]
+		if ok == false {
+			if expected && t.Patched {
+				return drift(DriftMissing, "patch not applied")
+			}
+			if expected {
+				return foreign("%s not installed by the template", fileKind(fi))
+			}
+			return nil, nil
+		}
+		h, ours, err := installedCopy(absTarget, recorded)
+		if err != nil {
+			return nil, err
+		}
+		if ours == false {
+			if fi.Mode().IsRegular() == false {
+				return inTheWay(DriftForeign, "replaced by a %s", fileKind(fi))
+			}
+			return inTheWay(DriftModified, "content %s instead of installed %s", shortHash(h), shortHash(recorded))
+		}
+		if expected == false {
+			return drift(DriftExtraneous, "should not be installed")
+		}
+		return nil, nil
+	}
+
+	dest, err := os.Readlink(absTarget)
+	if err != nil {
+		if expected {
+			return foreign("%s instead of a link to the template", fileKind(fi))
+		}
+		return nil, nil
+	}
+	switch {
+	case dest == path.Join(m.basepath, t.Datapath, rel):
+		if expected == false {
+			return drift(DriftExtraneous, "should not be installed")
+		}
+	case m.ownLink(t, rel, dest):
+		if expected {
+			return drift(DriftModified, "link to a previous content of the template")
+		}
+		return drift(DriftExtraneous, "link to a previous content of the template")
+	case strings.HasPrefix(dest, m.basepath+"/"):
+		d, _ := drift(DriftForeign, "link to removed template data %s", dest)
+		if expected == false {
+			d.Kind = DriftExtraneous
+		}
+		d.remove = true
+		return d, nil
+	case expected:
+		return foreign("link to %s", dest)
+	}
+	return nil, nil
+}
+
+func fileKind(fi os.FileInfo) string {
+	switch {
+	case fi.IsDir():
+		return "directory"
+	case fi.Mode()&os.ModeSymlink != 0:
+		return "symlink"
+	case fi.Mode().IsRegular():
+		return "regular file"
+	}
+	return "special file"
+}
+
+func shortHash(h string) string {
+	if len(h) > 12 {
+		return h[:12]
+	}
+	return h
+}
+
+// FixDrift removes what prevents applying templates again to a
+// version at basepath. Foreign and modified real files are kept with a
+// .orig suffix, links are removed.
+func (m *HashTemplateManager) FixDrift(basepath string, drifts []TemplateDrift) error {
+	if err := m.tryLock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+
+	for _, d := range drifts {
+		absTarget := path.Join(basepath, d.Path)
+		var err error
+		if d.remove {
+			err = os.Remove(absTarget)
+		} else if d.save {
+			err = saveAside(absTarget)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveAside renames p with a .orig suffix, without replacing a
+// previously saved file
+func saveAside(p string) error {
+	dest := p + ".orig"
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dest); os.IsNotExist(err) {
+			break
+		}
+		dest = fmt.Sprintf("%s.orig.%d", p, i)
+	}
+	log.Printf("Saving %s to %s", p, dest)
+	return os.Rename(p, dest)
+}
+
+// TemplateStatus returns the drift of each installed version. With fix,
+// drift is reconciled by applying templates again.
+func (m *SymlinkWebotsManager) TemplateStatus(fix bool) ([]VersionDrift, error) {
+	if fix {
+		if err := m.tryLock(); err != nil {
+			return nil, err
+		}
+	} else if err := m.tryRLock(); err != nil {
+		return nil, err
+	}
+	defer m.unlock()
+
+	var res []VersionDrift
+	for _, v := range m.installed {
+		basepath := path.Join(m.workpath, v.String())
+		drifts, err := m.templates.Drift(basepath, v)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(drifts, func(i, j int) bool { return drifts[i].Path < drifts[j].Path })
+		vd := VersionDrift{Version: v, Drifts: drifts}
+		if fix && len(drifts) != 0 {
+			if err := m.templates.FixDrift(basepath, drifts); err != nil {
+				return nil, err
+			}
+			// foreign files left alone prevent applying templates,
+			// they are reported in the remaining drift
+			if err := m.templates.ApplyTemplates(basepath, v); err != nil {
+				log.Printf("Could not apply templates to %s: %s", v, err)
+			}
+			if vd.Remaining, err = m.templates.Drift(basepath, v); err != nil {
+				return nil, err
+			}
+		}
+		res = append(res, vd)
+	}
+	return res, nil
+}
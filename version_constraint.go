@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A VersionConstraint selects versions with a comma separated list of
+// bounds that must all be satisfied, like ">=8.4,<8.6". A bound
+// without operator is a prefix: "8.4" or "8.4.*" selects any 8.4
+// version, and "8.4.1" only this version. Missing components of a
+// compared version are zeros: "<8.6" is "<8.6.0".
+type VersionConstraint struct {
+	bounds []versionBound
+}
+
+type versionBound struct {
+	op    string
+	parts []uint
+}
+
+var versionOperators = []string{">=", "<=", ">", "<", "="}
+
+func ParseVersionConstraint(s string) (VersionConstraint, error) {
+	res := VersionConstraint{}
+	for _, b := range strings.Split(s, ",") {
+		bound, err := parseVersionBound(strings.TrimSpace(b))
+		if err != nil {
+			return VersionConstraint{}, fmt.Errorf("Invalid version constraint %s: %s", s, err)
+		}
+		res.bounds = append(res.bounds, bound)
+	}
+	return res, nil
+}
+
+func parseVersionBound(s string) (versionBound, error) {
+	res := versionBound{}
+	for _, op := range versionOperators {
+		if strings.HasPrefix(s, op) {
+			res.op = op
+			s = strings.TrimSpace(strings.TrimPrefix(s, op))
+			break
+		}
+	}
+	// "=" is the same than no operator
+	if res.op == "=" {
+		res.op = ""
+	}
+	if len(s) == 0 {
+		return res, fmt.Errorf("missing version")
+	}
+
+	components := strings.Split(s, ".")
+	if len(components) > 3 {
+		return res, fmt.Errorf("too many components in %s", s)
+	}
+	for i, c := range components {
+		if c == "*" {
+			if i != len(components)-1 {
+				return res, fmt.Errorf("* should be the last component of %s", s)
+			}
+			if len(res.op) != 0 {
+				return res, fmt.Errorf("* cannot be used with %s", res.op)
+			}
+			break
+		}
+		n, err := strconv.ParseUint(c, 10, 0)
+		if err != nil {
+			return res, fmt.Errorf("invalid component %s in %s", c, s)
+		}
+		res.parts = append(res.parts, uint(n))
+	}
+	return res, nil
+}
+
+// ExactVersionConstraint returns the constraint selecting only v
+func ExactVersionConstraint(v WebotsVersion) VersionConstraint {
+	return VersionConstraint{
+		bounds: []versionBound{{parts: []uint{v.Major, v.Minor, v.Patch}}},
+	}
+}
+
+func compareVersions(a, b WebotsVersion) int {
+	l := WebotsVersionList{a, b}
+	if l.Less(0, 1) {
+		return -1
+	}
+	if l.Less(1, 0) {
+		return 1
+	}
+	return 0
+}
+
+func (b versionBound) matches(v WebotsVersion) bool {
+	actual := []uint{v.Major, v.Minor, v.Patch}
+	if len(b.op) == 0 {
+		for i, p := range b.parts {
+			if actual[i] != p {
+				return false
+			}
+		}
+		return true
+	}
+
+	parts := append(append([]uint(nil), b.parts...), 0, 0, 0)
+	c := compareVersions(v, WebotsVersion{Major: parts[0], Minor: parts[1], Patch: parts[2]})
+	switch b.op {
+	case ">=":
+		return c >= 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c < 0
+	}
+}
+
+// Matches returns true if v satisfies all bounds of the constraint
+func (c VersionConstraint) Matches(v WebotsVersion) bool {
+	for _, b := range c.bounds {
+		if b.matches(v) == false {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the normalized form of the constraint. Exact versions
+// are kept as is, so rules of older templates are unchanged.
+func (c VersionConstraint) String() string {
+	var res []string
+	for _, b := range c.bounds {
+		var parts []string
+		for _, p := range b.parts {
+			parts = append(parts, strconv.FormatUint(uint64(p), 10))
+		}
+		if len(b.op) == 0 && len(parts) < 3 {
+			parts = append(parts, "*")
+		}
+		res = append(res, b.op+strings.Join(parts, "."))
+	}
+	return strings.Join(res, ",")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVersionConstraint(t *testing.T) {
+	testdata := []struct {
+		constraint, version string
+		matches             bool
+		str                 string
+	}{
+		{">=8.5", "8.5.0", true, ">=8.5"},
+		{">=8.5", "8.4.9", false, ">=8.5"},
+		{"<8.6.0", "8.5.9", true, "<8.6.0"},
+		{"<8.6", "8.6.0", false, "<8.6"},
+		{"8.4.*", "8.4.3", true, "8.4.*"},
+		{"8.4.*", "8.5.0", false, "8.4.*"},
+		{"8.4", "8.4.1", true, "8.4.*"},
+		{"8.5.4", "8.5.4", true, "8.5.4"},
+		{"8.5.4", "8.5.40", false, "8.5.4"},
+		{"=8.5.4", "8.5.4", true, "8.5.4"},
+		{">8.5.4", "8.5.4", false, ">8.5.4"},
+		{">=8.0,<8.5", "8.4.2", true, ">=8.0,<8.5"},
+		{">=8.0,<8.5", "8.5.0", false, ">=8.0,<8.5"},
+		{"*", "1.2.3", true, "*"},
+	}
+
+	for _, d := range testdata {
+		c, err := ParseVersionConstraint(d.constraint)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", d.constraint, err)
+			continue
+		}
+		v, err := ParseWebotsVersion(d.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Matches(v) != d.matches {
+			t.Errorf("Expected %s to match %s: %v", d.constraint, d.version, d.matches)
+		}
+		if c.String() != d.str {
+			t.Errorf("Expected %s to be printed %s, got %s", d.constraint, d.str, c.String())
+		}
+	}
+
+	for _, s := range []string{"", ">=", "8.*.1", ">=8.*", "a", "1.2.3.4", "8.5,"} {
+		if _, err := ParseVersionConstraint(s); err == nil {
+			t.Errorf("Invalid constraint %q was accepted", s)
+		}
+	}
+}
+
+func TestNormalizeRules(t *testing.T) {
+	// rules written before version constraints were exact versions
+	rules, err := normalizeRules("conf/a.ini", map[string]bool{
+		"8.5.4":  true,
+		"=8.6.0": true,
+		"8.4":    true,
+		">=9.0":  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{
+		"8.5.4": true,
+		"8.6.0": true,
+		"8.4.*": true,
+		">=9.0": true,
+	}
+	if reflect.DeepEqual(rules, expected) == false {
+		t.Errorf("Expected rules %v, got %v", expected, rules)
+	}
+
+	if _, err := normalizeRules("conf/a.ini", map[string]bool{"8.*.1": true}); err == nil {
+		t.Errorf("Invalid rule was accepted")
+	}
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"regexp"
 	"runtime"
 	"sort"
@@ -117,10 +120,24 @@ func (a *HttpWebotsArchive) osPath(basepath string) (string, error) {
 }
 
 func (a *HttpWebotsArchive) archSuffix() (string, error) {
+	return webotsArch()
+}
+
+// webotsArch returns the architecture of webots versions to install,
+// as named by archives.
+func webotsArch() (string, error) {
 	if runtime.GOOS != "linux" {
 		return "", fmt.Errorf("%s is not supported yet", runtime.GOOS)
 	}
 
+	switch options.Arch {
+	case "":
+	case "i386", "x86-64":
+		return options.Arch, nil
+	default:
+		return "", fmt.Errorf("Unsupported architecture %s for webots, use i386 or x86-64", options.Arch)
+	}
+
 	switch runtime.GOARCH {
 	case "386":
 		return "i386", nil
@@ -136,10 +153,14 @@ func (a *HttpWebotsArchive) fileSuffix() string {
 }
 
 func (a *HttpWebotsArchive) load() error {
-	resp, err := http.Get(a.baseurl)
+	resp, err := httpClient().Get(a.baseurl)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Could not list %s: %s", a.baseurl, resp.Status)
+	}
 
 	tokenizer := html.NewTokenizer(resp.Body)
 
@@ -210,3 +231,99 @@ func (a *HttpWebotsArchive) GetUrl(v WebotsVersion) (string, error) {
 	}
 	return "", fmt.Errorf("Version %s not found", v)
 }
+
+// httpClient returns a client configured with the HTTP options. The
+// timeout only applies to connection and response headers, as
+// downloads can be long.
+func httpClient() *http.Client {
+	proxy := http.ProxyFromEnvironment
+	if len(options.HttpProxy) != 0 {
+		proxy = func(*http.Request) (*url.URL, error) {
+			return url.Parse(options.HttpProxy)
+		}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: proxy,
+			DialContext: (&net.Dialer{
+				Timeout: options.HttpTimeout,
+			}).DialContext,
+			TLSHandshakeTimeout:   options.HttpTimeout,
+			ResponseHeaderTimeout: options.HttpTimeout,
+		},
+	}
+}
+
+// MultiWebotsArchive combines several archives. When a version is
+// available in several of them, the first one is used.
+type MultiWebotsArchive struct {
+	archives []WebotsArchive
+	versions WebotsVersionList
+}
+
+func NewMultiWebotsArchive(archives ...WebotsArchive) *MultiWebotsArchive {
+	res := &MultiWebotsArchive{
+		archives: archives,
+	}
+	seen := make(map[WebotsVersion]bool)
+	for _, a := range archives {
+		for _, v := range a.AvailableVersions() {
+			if seen[v] {
+				continue
+			}
+			seen[v] = true
+			res.versions = append(res.versions, v)
+		}
+	}
+	sort.Sort(&res.versions)
+	return res
+}
+
+func (a *MultiWebotsArchive) AvailableVersions() []WebotsVersion {
+	return []WebotsVersion(a.versions)
+}
+
+func (a *MultiWebotsArchive) GetUrl(v WebotsVersion) (string, error) {
+	for _, aa := range a.archives {
+		if u, err := aa.GetUrl(v); err == nil {
+			return u, nil
+		}
+	}
+	return "", fmt.Errorf("Version %s not found", v)
+}
+
+// LazyWebotsArchive loads an archive only when it is first needed, so
+// commands not requiring it can work offline.
+type LazyWebotsArchive struct {
+	load    func() (WebotsArchive, error)
+	archive WebotsArchive
+	err     error
+}
+
+func NewLazyWebotsArchive(load func() (WebotsArchive, error)) *LazyWebotsArchive {
+	return &LazyWebotsArchive{load: load}
+}
+
+func (a *LazyWebotsArchive) get() (WebotsArchive, error) {
+	if a.archive == nil && a.err == nil {
+		a.archive, a.err = a.load()
+	}
+	return a.archive, a.err
+}
+
+func (a *LazyWebotsArchive) AvailableVersions() []WebotsVersion {
+	archive, err := a.get()
+	if err != nil {
+		log.Printf("Could not load archive: %s", err)
+		return nil
+	}
+	return archive.AvailableVersions()
+}
+
+func (a *LazyWebotsArchive) GetUrl(v WebotsVersion) (string, error) {
+	archive, err := a.get()
+	if err != nil {
+		return "", err
+	}
+	return archive.GetUrl(v)
+}
@@ -20,7 +20,6 @@ import (
 	"time"
 
 	"github.com/cheggaaa/pb"
-	"github.com/nightlyone/lockfile"
 )
 
 type WebotsInstanceManager interface {
@@ -29,6 +28,23 @@ type WebotsInstanceManager interface {
 	IsUsed(WebotsVersion) bool
 	Installed() []WebotsVersion
 	ApplyAllTemplates() error
+	ListTemplates() ([]TemplateListing, error)
+	TemplateStatus(fix bool) ([]VersionDrift, error)
+	DiskUsage() (*DiskUsageReport, error)
+	Dedup(only []WebotsVersion, dryRun bool) (DedupStats, error)
+	History() ([]UseRecord, error)
+	Rollback(steps int) (WebotsVersion, error)
+	Uninstall(WebotsVersion) error
+	Home(*WebotsVersion) (string, error)
+	Env(*WebotsVersion) ([]EnvVar, error)
+	Rehash() ([]string, error)
+	ShimExec(name string, args []string) error
+	HookEnv(dir string) ([]EnvVar, string, error)
+	GenerateModulefiles(dir, format string) error
+	ForgetModulefiles(dir string) error
+	Prune(keep int) ([]WebotsVersion, error)
+	Export(v WebotsVersion, w io.Writer) error
+	Import(r io.Reader, force bool) (WebotsVersion, error)
 }
 
 type SymlinkWebotsManager struct {
@@ -36,7 +52,7 @@ type SymlinkWebotsManager struct {
 	workpath    string
 	installpath string
 	usedpath    string
-	lock        lockfile.Lockfile
+	lock        *FileLock
 	installed   WebotsVersionList
 	inUse       *WebotsVersion
 	archive     WebotsArchive
@@ -44,7 +60,9 @@ type SymlinkWebotsManager struct {
 	gid         int
 }
 
-func NewSymlinkManager(a WebotsArchive) (*SymlinkWebotsManager, error) {
+// NewSymlinkManager opens the store of versions. If checkWebotsHome
+// is true, WEBOTS_HOME should point to the used version.
+func NewSymlinkManager(a WebotsArchive, checkWebotsHome bool) (*SymlinkWebotsManager, error) {
 	var err error
 	res := &SymlinkWebotsManager{
 		archive: a,
@@ -55,73 +73,189 @@ func NewSymlinkManager(a WebotsArchive) (*SymlinkWebotsManager, error) {
 		return nil, err
 	}
 
+	if options.User {
+		// per-user store does not need to be initialized
+		err = os.MkdirAll(res.workpath, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	res.templates, err = NewHasHTemplateManager(path.Join(res.workpath, "templates"))
 	if err != nil {
 		return nil, err
 	}
 
 	res.usedpath = path.Join(res.workpath, "used")
-	res.lock, err = lockfile.New(path.Join(res.workpath, "global.lock"))
+	res.lock, err = NewFileLock(path.Join(res.workpath, "global.lock"))
 	if err != nil {
 		return nil, err
 	}
 
-	err = res.listInstalled()
+	// taking the lock lists installed and used versions
+	err = res.tryRLock()
 	if err != nil {
 		return nil, err
 	}
-	err = res.listUsed()
-	if err != nil {
-		return nil, err
+	res.unlock()
+
+	if options.User == false {
+		err = res.checkGroup()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		res.gid = os.Getgid()
+	}
+
+	if checkWebotsHome {
+		err = res.checkWebotsHome()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// checkWebotsHome checks that WEBOTS_HOME points to the used version,
+// or to an installed version as set by the env command.
+func (m *SymlinkWebotsManager) checkWebotsHome() error {
+	webotsHome := os.Getenv("WEBOTS_HOME")
+	if len(webotsHome) == 0 {
+		fmt.Printf("WEBOTS_HOME is not set, please consider exporting WEBOTS_HOME=%s\n", m.installpath)
+		return nil
+	}
+	if webotsHome == m.installpath {
+		return nil
 	}
+	for _, v := range m.installed {
+		if path.Clean(webotsHome) == path.Join(m.workpath, v.String()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid WEBOTS_HOME=%s, please use WEBOTS_HOME=%s", webotsHome, m.installpath)
+}
 
-	//checks that we have the right gid
-	res.gid, err = getGid("webots-manager")
+// Home returns the directory of an installed version, to be used as
+// WEBOTS_HOME. If v is nil, the path to the used version is returned.
+func (m *SymlinkWebotsManager) Home(v *WebotsVersion) (string, error) {
+	if v == nil {
+		return m.installpath, nil
+	}
+	if m.isInstalled(*v) == false {
+		return "", fmt.Errorf("Version %s is not installed", *v)
+	}
+	return path.Join(m.workpath, v.String()), nil
+}
+
+// checks that we have the right gid
+func (m *SymlinkWebotsManager) checkGroup() error {
+	var err error
+	m.gid, err = getGid("webots-manager")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	found := false
 	userGroups, err := os.Getgroups()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	for _, g := range userGroups {
-		if g == res.gid {
+		if g == m.gid {
 			found = true
 			break
 		}
 	}
 
 	if found == false {
-		return nil, fmt.Errorf("Current use is not in 'webots-manager' group")
-	}
-
-	webotsHome := os.Getenv("WEBOTS_HOME")
-	if len(webotsHome) == 0 {
-		fmt.Printf("WEBOTS_HOME is not set, please consider exporting WEBOTS_HOME=%s", res.installpath)
-	} else if webotsHome != res.installpath {
-		return nil, fmt.Errorf("Invalid WEBOTS_HOME=%s, please use WEBOTS_HOME=%s", webotsHome, res.installpath)
+		return fmt.Errorf("Current use is not in 'webots-manager' group, you may use --user for a per-user installation")
 	}
-
-	return res, nil
+	return nil
 }
 
+// symlinkManagerPath returns the install root, the workpath where
+// versions are stored, and the path to the used version.
 func symlinkManagerPath() (string, string, string, error) {
 	if runtime.GOOS != "linux" {
 		return "", "", "", fmt.Errorf("Only linux is supported yet")
 	}
-	basepath := "/usr/local"
+	if options.User {
+		basepath, err := xdgDataHome()
+		if err != nil {
+			return "", "", "", err
+		}
+		// there is no system wide symlink, webots is used directly
+		// from the workpath.
+		workpath := path.Join(basepath, "webots-manager")
+		return basepath, workpath, path.Join(workpath, "used"), nil
+	}
+	if path.IsAbs(options.Root) == false {
+		return "", "", "", fmt.Errorf("Install root %s must be an absolute path", options.Root)
+	}
+	basepath := path.Clean(options.Root)
 	workpath := path.Join(basepath, "webots-manager")
 	installpath := path.Join(basepath, "webots")
 	return basepath, workpath, installpath, nil
 
 }
 
+// xdgDataHome returns the per-user data directory, according to the
+// XDG base directory specification.
+func xdgDataHome() (string, error) {
+	if dataHome := os.Getenv("XDG_DATA_HOME"); path.IsAbs(dataHome) {
+		return path.Clean(dataHome), nil
+	}
+	home := os.Getenv("HOME")
+	if path.IsAbs(home) == false {
+		return "", fmt.Errorf("Cannot find per-user data directory, neither XDG_DATA_HOME nor HOME are set")
+	}
+	return path.Join(home, ".local", "share"), nil
+}
+
+// UserManagerInit prepares the per-user store, and prints how to use
+// it.
+func UserManagerInit() error {
+	_, workpath, installpath, err := symlinkManagerPath()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(workpath, 0755)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Per-user versions will be stored in %s. Please add to your shell profile:\n", workpath)
+	fmt.Printf("  export WEBOTS_HOME=%s\n", installpath)
+	return nil
+}
+
 func (i *SymlinkWebotsManager) tryLock() error {
-	if err := i.lock.TryLock(); err != nil {
-		return fmt.Errorf("Could not lock %s: %s", i.lock, err)
+	if err := i.lock.Lock(); err != nil {
+		return err
+	}
+	return i.refresh()
+}
+
+// tryRLock takes the lock shared with other read-only commands
+func (i *SymlinkWebotsManager) tryRLock() error {
+	if err := i.lock.RLock(); err != nil {
+		return err
+	}
+	return i.refresh()
+}
+
+// refresh reloads installed and used versions, as they may have been
+// modified while we waited for the lock.
+func (i *SymlinkWebotsManager) refresh() error {
+	err := i.listInstalled()
+	if err == nil {
+		err = i.listUsed()
+	}
+	if err != nil {
+		i.unlock()
+		return err
 	}
 	return nil
 }
@@ -133,11 +267,6 @@ func (i *SymlinkWebotsManager) unlock() {
 }
 
 func (i *SymlinkWebotsManager) listInstalled() error {
-	if err := i.tryLock(); err != nil {
-		return err
-	}
-	defer i.unlock()
-
 	files, err := ioutil.ReadDir(i.workpath)
 	if err != nil {
 		return err
@@ -209,13 +338,33 @@ func (r *ProgressReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
-func (m *SymlinkWebotsManager) extractFile(v WebotsVersion, h *tar.Header, r io.Reader) error {
+// archiveEntryPath returns the path of an archive entry relative to
+// the extracted tree. Entries and link targets leaving the tree are
+// rejected, so an archive cannot write outside of its version.
+func archiveEntryPath(h *tar.Header) (string, error) {
+	name := strings.TrimPrefix(h.Name, "webots/")
+	rel := path.Clean(name)
+	if path.IsAbs(name) || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("Entry %s is outside of the archive root", h.Name)
+	}
+	if h.Typeflag == tar.TypeSymlink {
+		target := path.Clean(path.Join(path.Dir(rel), h.Linkname))
+		if path.IsAbs(h.Linkname) || target == ".." || strings.HasPrefix(target, "../") {
+			return "", fmt.Errorf("Link %s to %s points outside of the archive root", h.Name, h.Linkname)
+		}
+	}
+	return rel, nil
+}
 
-	dest := strings.TrimPrefix(h.Name, "webots/")
-	dest = path.Join(m.workpath, v.String(), dest)
-	if dest == path.Join(m.workpath, v.String()) {
+func extractFile(root string, h *tar.Header, r io.Reader) error {
+	rel, err := archiveEntryPath(h)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
 		return nil
 	}
+	dest := path.Join(root, rel)
 
 	switch h.Typeflag {
 	case tar.TypeReg, tar.TypeRegA:
@@ -224,11 +373,8 @@ func (m *SymlinkWebotsManager) extractFile(v WebotsVersion, h *tar.Header, r io.
 		if err != nil {
 			return err
 		}
-		f, err := os.Create(dest)
-		if err != nil {
-			return err
-		}
-		_, err = io.Copy(f, r)
+		// dest may be hardlinked with other versions
+		err = writeUnshared(dest, r, h.FileInfo().Mode())
 		if err != nil {
 			return err
 		}
@@ -252,7 +398,7 @@ func (m *SymlinkWebotsManager) extractFile(v WebotsVersion, h *tar.Header, r io.
 		return fmt.Errorf("Internal error, cannot handle file %s", h.Name)
 	}
 
-	err := os.Chtimes(dest, time.Now(), h.FileInfo().ModTime())
+	err = os.Chtimes(dest, time.Now(), h.FileInfo().ModTime())
 	if err != nil {
 		return err
 	}
@@ -265,21 +411,53 @@ func (m *SymlinkWebotsManager) extractFile(v WebotsVersion, h *tar.Header, r io.
 	return nil
 }
 
-func (m *SymlinkWebotsManager) uncompressFromHttp(v WebotsVersion, addr string) error {
-	dest := path.Join(m.workpath, v.String())
-	err := os.RemoveAll(dest)
+// extractionPrefix names the temporary directories versions are
+// extracted into, before being renamed in place once complete. Any
+// left in the workpath were abandoned by an interrupted command.
+const extractionPrefix = ".extract-"
+
+// extractionDir creates a temporary directory to extract a version
+func (m *SymlinkWebotsManager) extractionDir() (string, error) {
+	tmp, err := ioutil.TempDir(m.workpath, extractionPrefix)
 	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp, 0775|os.ModeSetgid); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// replaceVersion puts the extracted tree tmp in place of version
+// v. What templates recorded about a previous tree of v is forgotten,
+// as none of it is in the new one.
+func (m *SymlinkWebotsManager) replaceVersion(v WebotsVersion, tmp string) error {
+	dest := path.Join(m.workpath, v.String())
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	if err := m.templates.ForgetVersion(v); err != nil {
 		return err
 	}
-	err = os.MkdirAll(dest, 0775|os.ModeSetgid)
+	return os.Rename(tmp, dest)
+}
+
+func (m *SymlinkWebotsManager) uncompressFromHttp(v WebotsVersion, addr string) error {
+	tmp, err := m.extractionDir()
 	if err != nil {
 		return err
 	}
+	defer os.RemoveAll(tmp)
 
-	resp, err := http.Get(addr)
+	resp, err := httpClient().Get(addr)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Could not download %s: %s", addr, resp.Status)
+	}
 
 	var netReader io.Reader = resp.Body
 	if resp.ContentLength >= 0 {
@@ -310,12 +488,13 @@ func (m *SymlinkWebotsManager) uncompressFromHttp(v WebotsVersion, addr string)
 		if err != nil {
 			return err
 		}
-		err = m.extractFile(v, fileHeader, tarReader)
+		err = extractFile(tmp, fileHeader, tarReader)
 		if err != nil {
 			return fmt.Errorf("Cannot extract %s: %s", fileHeader.Name, err)
 		}
 	}
-	return nil
+
+	return m.replaceVersion(v, tmp)
 }
 
 func (m *SymlinkWebotsManager) install(v WebotsVersion) error {
@@ -350,9 +529,22 @@ func (m *SymlinkWebotsManager) install(v WebotsVersion) error {
 		log.Printf("Successfuly re-installed %s", v)
 	}
 
+	m.installedChanged()
 	return nil
 }
 
+// installedChanged updates everything that depends on the list of
+// installed versions. Failures are only reported, as the store itself
+// is consistent.
+func (m *SymlinkWebotsManager) installedChanged() {
+	if _, err := m.rehash(); err != nil {
+		log.Printf("Could not update shims in %s: %s", m.shimsPath(), err)
+	}
+	if err := m.updateModulefiles(); err != nil {
+		log.Printf("%s", err)
+	}
+}
+
 func (m *SymlinkWebotsManager) Install(v WebotsVersion) error {
 	if err := m.tryLock(); err != nil {
 		return err
@@ -406,7 +598,10 @@ func getGid(g string) (int, error) {
 	return -1, nil
 }
 
-func SymlinkManagerSystemInit() error {
+// SymlinkManagerSystemInit prepares the system for the
+// manager. If adopt is true, an existing manual installation in the
+// install path is moved to the workpath and used.
+func SymlinkManagerSystemInit(adopt bool) error {
 	if os.Getuid() != 0 || os.Geteuid() != 0 {
 		return fmt.Errorf("need to be root")
 	}
@@ -455,6 +650,16 @@ func SymlinkManagerSystemInit() error {
 	if err != nil && os.IsNotExist(err) == false {
 		return err
 	}
+	if err == nil && (fi.Mode()&os.ModeSymlink) != os.ModeSymlink && adopt == true {
+		err = adoptInstallation(installpath, workpath, gid)
+		if err != nil {
+			return err
+		}
+		fi, err = os.Lstat(installpath)
+		if err != nil && os.IsNotExist(err) == false {
+			return err
+		}
+	}
 	usedpath := path.Join(workpath, "used")
 	if os.IsNotExist(err) {
 		err := os.Symlink(usedpath, installpath)
@@ -463,7 +668,7 @@ func SymlinkManagerSystemInit() error {
 		}
 	} else {
 		if (fi.Mode() & os.ModeSymlink) != os.ModeSymlink {
-			return fmt.Errorf("Webots seems already installed in %s, you should remove it.", installpath)
+			return fmt.Errorf("Webots seems already installed in %s, you should remove it, or adopt it with --adopt.", installpath)
 		}
 
 		dest, err := os.Readlink(installpath)
@@ -499,6 +704,12 @@ func (m *SymlinkWebotsManager) Use(v WebotsVersion) error {
 		}
 	}
 
+	return m.use(v)
+}
+
+func (m *SymlinkWebotsManager) use(v WebotsVersion) error {
+	previous := m.inUse
+
 	err := os.RemoveAll(m.usedpath)
 	if err != nil {
 		return err
@@ -510,7 +721,12 @@ func (m *SymlinkWebotsManager) Use(v WebotsVersion) error {
 
 	m.inUse = &v
 
-	return nil
+	// the default modulefile is the used version
+	if err := m.updateModulefiles(); err != nil {
+		log.Printf("%s", err)
+	}
+
+	return recordUse(m.workpath, previous, v)
 }
 
 func (m *SymlinkWebotsManager) ApplyAllTemplates() error {
@@ -522,3 +738,65 @@ func (m *SymlinkWebotsManager) ApplyAllTemplates() error {
 	}
 	return nil
 }
+
+func (m *SymlinkWebotsManager) Uninstall(v WebotsVersion) error {
+	if err := m.tryLock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+	return m.uninstall(v)
+}
+
+func (m *SymlinkWebotsManager) uninstall(v WebotsVersion) error {
+	if m.isInstalled(v) == false {
+		return fmt.Errorf("Version %s is not installed", v)
+	}
+	if m.IsUsed(v) {
+		return fmt.Errorf("Version %s is in use, please use another version first", v)
+	}
+
+	err := os.RemoveAll(path.Join(m.workpath, v.String()))
+	if err != nil {
+		return err
+	}
+	err = m.templates.ForgetVersion(v)
+	if err != nil {
+		return err
+	}
+
+	installed := m.installed[:0]
+	for _, vv := range m.installed {
+		if vv != v {
+			installed = append(installed, vv)
+		}
+	}
+	m.installed = installed
+	log.Printf("Successfuly removed %s", v)
+	m.installedChanged()
+	return nil
+}
+
+// Prune removes the oldest versions, so at most keep versions are
+// installed. The version in use is always kept.
+func (m *SymlinkWebotsManager) Prune(keep int) ([]WebotsVersion, error) {
+	if err := m.tryLock(); err != nil {
+		return nil, err
+	}
+	defer m.unlock()
+
+	var removed []WebotsVersion
+	candidates := append([]WebotsVersion(nil), m.installed...)
+	for _, v := range candidates {
+		if len(m.installed) <= keep {
+			break
+		}
+		if m.IsUsed(v) {
+			continue
+		}
+		if err := m.uninstall(v); err != nil {
+			return removed, err
+		}
+		removed = append(removed, v)
+	}
+	return removed, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// newTestManager returns a manager with a store in a temporary
+// directory
+func newTestManager(t *testing.T) (*SymlinkWebotsManager, func()) {
+	dir, err := ioutil.TempDir("", "webots-manager-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &SymlinkWebotsManager{
+		basepath:    dir,
+		workpath:    path.Join(dir, "webots-manager"),
+		installpath: path.Join(dir, "webots"),
+	}
+	m.usedpath = path.Join(m.workpath, "used")
+	if err := os.MkdirAll(m.workpath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if m.templates, err = NewHasHTemplateManager(path.Join(m.workpath, "templates")); err != nil {
+		t.Fatal(err)
+	}
+	if m.lock, err = NewFileLock(path.Join(m.workpath, "global.lock")); err != nil {
+		t.Fatal(err)
+	}
+	return m, func() { os.RemoveAll(dir) }
+}
+
+// writeTestTree writes files, relative to root, with their content
+func writeTestTree(t *testing.T, root string, files map[string]string) {
+	for rel, content := range files {
+		p := path.Join(root, rel)
+		if err := os.MkdirAll(path.Dir(p), 0775); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	for _, v := range []string{"8.4.0", "8.5.0", "8.5.4", "8.6.0"} {
+		writeTestTree(t, path.Join(m.workpath, v), map[string]string{"webots": "webots"})
+	}
+	if err := os.Symlink("8.4.0", m.usedpath); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := m.Prune(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the oldest version is in use, and kept
+	expected := []string{"8.5.0", "8.5.4"}
+	if len(removed) != len(expected) {
+		t.Fatalf("Expected to remove %v, removed %v", expected, removed)
+	}
+	for i, v := range removed {
+		if v.String() != expected[i] {
+			t.Errorf("Expected to remove %v, removed %v", expected, removed)
+		}
+		if _, err := os.Stat(path.Join(m.workpath, v.String())); os.IsNotExist(err) == false {
+			t.Errorf("%s is still in the store", v)
+		}
+	}
+	if len(m.Installed()) != 2 {
+		t.Errorf("Expected 2 installed versions, got %v", m.Installed())
+	}
+}
+
+func TestReinstallWithTemplates(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	v, err := ParseWebotsVersion("8.5.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := path.Join(m.workpath, v.String())
+	writeTestTree(t, root, map[string]string{
+		"webots":           "webots",
+		"resources/a.conf": "shipped",
+		"conf/b.ini":       "line1\nline2\n",
+	})
+
+	writeTestTree(t, m.basepath, map[string]string{"a.conf": "overridden"})
+	if err := m.templates.RegisterTemplate(path.Join(m.basepath, "a.conf"), "resources/a.conf"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.templates.Override("resources/a.conf"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestTree(t, m.basepath, map[string]string{"b.patch": "@@ -1,2 +1,2 @@\n line1\n-line2\n+patched\n"})
+	if err := m.templates.RegisterTemplate(path.Join(m.basepath, "b.patch"), "conf/b.ini"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.templates.Patch("conf/b.ini"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.listInstalled(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ApplyAllTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a re-installation extracts a fresh tree, with the shipped files
+	// the templates replaced
+	tmp, err := m.extractionDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestTree(t, tmp, map[string]string{
+		"webots":           "webots",
+		"resources/a.conf": "shipped again",
+		"conf/b.ini":       "line0\nline1\nline2\n",
+	})
+	if err := m.replaceVersion(v, tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ApplyAllTemplates(); err != nil {
+		t.Fatalf("Could not apply templates to the re-installed version: %s", err)
+	}
+
+	expected := map[string]string{
+		"resources/a.conf": "overridden",
+		"conf/b.ini":       "line0\nline1\npatched\n",
+	}
+	for rel, content := range expected {
+		data, err := ioutil.ReadFile(path.Join(root, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("Expected %q in %s, got %q", content, rel, data)
+		}
+	}
+
+	backup, ok, err := m.templates.TemplateBackup("resources/a.conf", v, "")
+	if err != nil || ok == false {
+		t.Fatalf("No backup of resources/a.conf: %v", err)
+	}
+	data, err := ioutil.ReadFile(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "shipped again" {
+		t.Errorf("Expected the backup of the re-installed file, got %q", data)
+	}
+}